@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+type (
+	// Accumulator is the first layer of a network before its activation, that
+	// is kept up to date incrementally the way engines do on make/unmake.
+	// Perspective networks have an accumulator for each color, the others only
+	// use the white one
+	Accumulator struct {
+		net    *Network
+		Values [2][]float32
+		PSQT   [2][]float32
+	}
+
+	// QuantizedAccumulator is an Accumulator over the first layer weights and
+	// the PSQT weights, multiplied by QuantizationScale and rounded to
+	// integers
+	QuantizedAccumulator struct {
+		net     *Network
+		weights []int16
+		biases  []int16
+		psqt    []int32
+		Values  [2][]int16
+		PSQT    [2][]int32
+	}
+)
+
+// QuantizationScale is the factor of the first layer weights and biases of
+// quantized accumulators
+var QuantizationScale float32 = 255
+
+func NewAccumulator(n *Network) *Accumulator {
+	acc := &Accumulator{net: n}
+	for c := range acc.Values {
+		acc.Values[c] = make([]float32, n.Weights[0].Rows)
+		acc.PSQT[c] = make([]float32, n.PSQT.Rows)
+	}
+	return acc
+}
+
+// Refresh recomputes the accumulator of the position from scratch
+func (acc *Accumulator) Refresh(pos *Position) {
+	white, black := perspectives(acc.net.FeatureSet(), pos)
+	for c, features := range [][]int16{white, black} {
+		copy(acc.Values[c], acc.net.Biases[0].Data)
+		for i := range acc.PSQT[c] {
+			acc.PSQT[c][i] = 0
+		}
+		for _, f := range features {
+			acc.Add(Color(c), f)
+		}
+	}
+}
+
+// Add activates a feature of the color's perspective
+func (acc *Accumulator) Add(color Color, feature int16) {
+	column := acc.net.Weights[0].Data[uint32(feature)*acc.net.Weights[0].Rows:]
+	for i := range acc.Values[color] {
+		acc.Values[color][i] += column[i]
+	}
+	if acc.net.Topology.PSQT {
+		column := acc.net.PSQT.Data[uint32(feature)*acc.net.PSQT.Rows:]
+		for i := range acc.PSQT[color] {
+			acc.PSQT[color][i] += column[i]
+		}
+	}
+}
+
+// Remove deactivates a feature of the color's perspective
+func (acc *Accumulator) Remove(color Color, feature int16) {
+	column := acc.net.Weights[0].Data[uint32(feature)*acc.net.Weights[0].Rows:]
+	for i := range acc.Values[color] {
+		acc.Values[color][i] -= column[i]
+	}
+	if acc.net.Topology.PSQT {
+		column := acc.net.PSQT.Data[uint32(feature)*acc.net.PSQT.Rows:]
+		for i := range acc.PSQT[color] {
+			acc.PSQT[color][i] -= column[i]
+		}
+	}
+}
+
+// Update applies the features that differ between the two positions
+func (acc *Accumulator) Update(before, after *Position) {
+	featureChanges(acc.net.FeatureSet(), before, after, acc.Add, acc.Remove)
+}
+
+// Evaluate runs the rest of the network over the accumulator, the outputs are
+// only valid until the next prediction
+func (acc *Accumulator) Evaluate(pos *Position) []float32 {
+	stm, nstm := pos.SideToMove, 1-pos.SideToMove
+	if !acc.net.FeatureSet().Perspective() {
+		stm = White
+	}
+	return acc.net.evaluate(pos, acc.Values[stm], acc.Values[nstm], acc.PSQT[stm], acc.PSQT[nstm])
+}
+
+func NewQuantizedAccumulator(n *Network) *QuantizedAccumulator {
+	acc := &QuantizedAccumulator{
+		net:     n,
+		weights: make([]int16, len(n.Weights[0].Data)),
+		biases:  make([]int16, len(n.Biases[0].Data)),
+		psqt:    make([]int32, len(n.PSQT.Data)),
+	}
+	for i, w := range n.Weights[0].Data {
+		acc.weights[i] = int16(quantize(w))
+	}
+	for i, b := range n.Biases[0].Data {
+		acc.biases[i] = int16(quantize(b))
+	}
+	for i, w := range n.PSQT.Data {
+		acc.psqt[i] = quantize(w)
+	}
+	for c := range acc.Values {
+		acc.Values[c] = make([]int16, n.Weights[0].Rows)
+		acc.PSQT[c] = make([]int32, n.PSQT.Rows)
+	}
+	return acc
+}
+
+func quantize(x float32) int32 {
+	return int32(math.Round(float64(x * QuantizationScale)))
+}
+
+// Refresh recomputes the accumulator of the position from scratch
+func (acc *QuantizedAccumulator) Refresh(pos *Position) {
+	white, black := perspectives(acc.net.FeatureSet(), pos)
+	for c, features := range [][]int16{white, black} {
+		copy(acc.Values[c], acc.biases)
+		for i := range acc.PSQT[c] {
+			acc.PSQT[c][i] = 0
+		}
+		for _, f := range features {
+			acc.Add(Color(c), f)
+		}
+	}
+}
+
+// Add activates a feature of the color's perspective
+func (acc *QuantizedAccumulator) Add(color Color, feature int16) {
+	rows := acc.net.Weights[0].Rows
+	column := acc.weights[uint32(feature)*rows:]
+	for i := range acc.Values[color] {
+		acc.Values[color][i] += column[i]
+	}
+	if acc.net.Topology.PSQT {
+		column := acc.psqt[uint32(feature)*acc.net.PSQT.Rows:]
+		for i := range acc.PSQT[color] {
+			acc.PSQT[color][i] += column[i]
+		}
+	}
+}
+
+// Remove deactivates a feature of the color's perspective
+func (acc *QuantizedAccumulator) Remove(color Color, feature int16) {
+	rows := acc.net.Weights[0].Rows
+	column := acc.weights[uint32(feature)*rows:]
+	for i := range acc.Values[color] {
+		acc.Values[color][i] -= column[i]
+	}
+	if acc.net.Topology.PSQT {
+		column := acc.psqt[uint32(feature)*acc.net.PSQT.Rows:]
+		for i := range acc.PSQT[color] {
+			acc.PSQT[color][i] -= column[i]
+		}
+	}
+}
+
+// Update applies the features that differ between the two positions
+func (acc *QuantizedAccumulator) Update(before, after *Position) {
+	featureChanges(acc.net.FeatureSet(), before, after, acc.Add, acc.Remove)
+}
+
+// Evaluate dequantizes the accumulator and runs the rest of the network over
+// it, the outputs are only valid until the next prediction
+func (acc *QuantizedAccumulator) Evaluate(pos *Position) []float32 {
+	stm, nstm := pos.SideToMove, 1-pos.SideToMove
+	if !acc.net.FeatureSet().Perspective() {
+		stm = White
+	}
+	dequantize := func(values []int16, psqt []int32) ([]float32, []float32) {
+		fvalues := make([]float32, len(values))
+		for i, v := range values {
+			fvalues[i] = float32(v) / QuantizationScale
+		}
+		fpsqt := make([]float32, len(psqt))
+		for i, v := range psqt {
+			fpsqt[i] = float32(v) / QuantizationScale
+		}
+		return fvalues, fpsqt
+	}
+	stmValues, stmPSQT := dequantize(acc.Values[stm], acc.PSQT[stm])
+	nstmValues, nstmPSQT := dequantize(acc.Values[nstm], acc.PSQT[nstm])
+	return acc.net.evaluate(pos, stmValues, nstmValues, stmPSQT, nstmPSQT)
+}
+
+// Equals reports whether both accumulators hold the exact same values
+func (acc *QuantizedAccumulator) Equals(other *QuantizedAccumulator) bool {
+	for c := range acc.Values {
+		for i, v := range acc.Values[c] {
+			if v != other.Values[c][i] {
+				return false
+			}
+		}
+		for i, v := range acc.PSQT[c] {
+			if v != other.PSQT[c][i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// perspectives splits the features of the position by the color that sees
+// them, feature sets without perspective only have white features
+func perspectives(features FeatureSet, pos *Position) (white, black []int16) {
+	input := features.Encode(pos)
+	if !features.Perspective() {
+		return input, nil
+	}
+	half := len(input) / 2
+	if pos.SideToMove == White {
+		return input[:half], input[half:]
+	}
+	return input[half:], input[:half]
+}
+
+// featureChanges calls remove and add for the features of each color that
+// differ between the two positions
+func featureChanges(features FeatureSet, before, after *Position, add, remove func(Color, int16)) {
+	beforeWhite, beforeBlack := perspectives(features, before)
+	afterWhite, afterBlack := perspectives(features, after)
+	diff := func(color Color, old, new []int16) {
+		oldSet := make(map[int16]bool, len(old))
+		for _, f := range old {
+			oldSet[f] = true
+		}
+		newSet := make(map[int16]bool, len(new))
+		for _, f := range new {
+			newSet[f] = true
+		}
+		for _, f := range old {
+			if !newSet[f] {
+				remove(color, f)
+			}
+		}
+		for _, f := range new {
+			if !oldSet[f] {
+				add(color, f)
+			}
+		}
+	}
+	diff(White, beforeWhite, afterWhite)
+	diff(Black, beforeBlack, afterBlack)
+}
+
+// evaluate runs the network over the accumulations (biases included) of the
+// side to move and the other side
+func (n *Network) evaluate(pos *Position, stm, nstm, stmPSQT, nstmPSQT []float32) []float32 {
+	n.bucket = n.Topology.Bucket(pos.PieceCount())
+
+	activationFn := n.Topology.Activations[0].Apply
+	output := n.Activations[0].Data
+	for i, v := range stm {
+		output[i] = activationFn(v)
+	}
+	if n.Topology.Perspective {
+		for i, v := range nstm {
+			output[len(stm)+i] = activationFn(v)
+		}
+	}
+
+	var skip []float32
+	if n.Topology.PSQT {
+		offset := n.rowOffset(len(n.Activations) - 1)
+		skip = make([]float32, n.Topology.Outputs)
+		for i := range skip {
+			if n.Topology.Perspective {
+				skip[i] = (stmPSQT[offset+uint32(i)] - nstmPSQT[offset+uint32(i)]) / 2
+			} else {
+				skip[i] = stmPSQT[offset+uint32(i)]
+			}
+		}
+	}
+	return n.propagate(skip)
+}
+
+// CheckParity plays the moves from the FEN, keeping float and quantized
+// accumulators up to date incrementally, and returns the largest difference
+// of each of them from Predict. The difference of the quantized accumulator
+// includes the error of the quantization itself
+func (n *Network) CheckParity(fen string, moves []string) (float32, float32) {
+	if n.Topology.Factorized {
+		n = n.Fold()
+	}
+	features := n.FeatureSet()
+
+	pos := ParseFen(fen)
+	acc := NewAccumulator(n)
+	acc.Refresh(&pos)
+	quantized := NewQuantizedAccumulator(n)
+	quantized.Refresh(&pos)
+	refreshed := NewQuantizedAccumulator(n)
+
+	floatDiff, quantizedDiff := float32(0), float32(0)
+	compare := func() {
+		expected := append([]float32{}, n.Predict(features.Encode(&pos))...)
+		for i, v := range acc.Evaluate(&pos) {
+			floatDiff = float32(math.Max(float64(floatDiff), math.Abs(float64(v-expected[i]))))
+		}
+		for i, v := range quantized.Evaluate(&pos) {
+			quantizedDiff = float32(math.Max(float64(quantizedDiff), math.Abs(float64(v-expected[i]))))
+		}
+	}
+
+	compare()
+	for _, move := range moves {
+		next := pos.Play(ParseMove(move))
+		acc.Update(&pos, &next)
+		quantized.Update(&pos, &next)
+		pos = next
+
+		refreshed.Refresh(&pos)
+		if !quantized.Equals(refreshed) {
+			panic(fmt.Sprintf("Quantized accumulator of %s differs from a refresh after move %s", fen, move))
+		}
+		compare()
+	}
+	return floatDiff, quantizedDiff
+}
+
+// CheckParityFile runs CheckParity over every line of the file, each line is
+// a FEN optionally followed by `moves` and a list of moves in UCI notation
+func CheckParityFile(n *Network, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	maxFloat, maxQuantized := float32(0), float32(0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fen, moves := line, []string{}
+		if i := strings.Index(line, " moves"); i != -1 {
+			fen, moves = line[:i], strings.Fields(line[i+len(" moves"):])
+		}
+		floatDiff, quantizedDiff := n.CheckParity(fen, moves)
+		fmt.Printf("%s: float difference %f, quantized difference %f\n", line, floatDiff, quantizedDiff)
+		if floatDiff > maxFloat {
+			maxFloat = floatDiff
+		}
+		if quantizedDiff > maxQuantized {
+			maxQuantized = quantizedDiff
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Largest float difference %f, largest quantized difference %f\n", maxFloat, maxQuantized)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+var parityGame = []string{
+	"e2e4", "e7e5", "g1f3", "b8c6", "f1c4", "g8f6", "e1g1", "f6e4", "d2d4", "e5d4",
+	"f1e1", "d7d5", "c4d5", "d8d5", "b1c3", "d5c4", "c3e4", "c8e6", "e4g5", "e8c8",
+}
+
+func TestAccumulatorParity(t *testing.T) {
+	topologies := []Topology{
+		NewTopology(769, 1, []uint32{16}),
+		NewTopology(768, 2, []uint32{16, 8}),
+		NewTopology(0, 1, []uint32{8}),
+	}
+	topologies[1].Perspective = true
+	topologies[1].PSQT = true
+	topologies[1].OutputBuckets = 4
+	topologies[1].Heads = DefaultOutputHeads(2)
+	topologies[2].Features = HalfKAFeatures
+	topologies[2].Perspective = true
+	topologies[2].KingBuckets = 4
+	topologies[2].MirrorKings = true
+	topologies[2].PSQT = true
+	topologies[2].Factorized = true
+	topologies[2].Inputs = topologies[2].FeatureSet().Size()
+
+	for _, top := range topologies {
+		net := CreateNetwork(top, 30)
+		floatDiff, quantizedDiff := net.CheckParity("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", parityGame)
+		if floatDiff > 1e-5 {
+			t.Errorf("Incremental float evaluation of %s is off by %f", top.FeatureSet().Name(), floatDiff)
+		}
+		if quantizedDiff > 1e-2 {
+			t.Errorf("Incremental quantized evaluation of %s is off by %f", top.FeatureSet().Name(), quantizedDiff)
+		}
+	}
+}
+
+func TestAccumulatorUpdate(t *testing.T) {
+	top := NewTopology(768, 1, []uint32{4})
+	top.Perspective = true
+	net := CreateNetwork(top, 30)
+
+	before := ParseFen("4k3/8/8/8/8/8/4P3/4K3 w - - 0 1")
+	after := before.Play(ParseMove("e2e4"))
+	acc := NewAccumulator(&net)
+	acc.Refresh(&before)
+	acc.Update(&before, &after)
+
+	refreshed := NewAccumulator(&net)
+	refreshed.Refresh(&after)
+	for c := range acc.Values {
+		if !sameApproxArray(refreshed.Values[c], acc.Values[c]) {
+			t.Errorf("Got %v, Expected %v", acc.Values[c], refreshed.Values[c])
+		}
+	}
+}
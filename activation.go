@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Activation is the activation function of a layer
+type Activation uint32
+
+const (
+	ReLuActivation Activation = iota
+	ClippedReLuActivation
+	SquaredClippedReLuActivation
+	LinearActivation
+	SigmoidActivation
+)
+
+var activationNames = []string{"relu", "crelu", "screlu", "linear", "sigmoid"}
+
+func (a Activation) String() string {
+	if int(a) < len(activationNames) {
+		return activationNames[a]
+	}
+	return fmt.Sprintf("unknown(%d)", a)
+}
+
+// ParseActivation returns the activation that has the given name
+func ParseActivation(name string) Activation {
+	for i, n := range activationNames {
+		if strings.EqualFold(n, name) {
+			return Activation(i)
+		}
+	}
+	panic(fmt.Sprintf("Unknown activation %s, expected one of %s", name, activationNames))
+}
+
+// Apply applies the activation function to the output of a neuron
+func (a Activation) Apply(x float32) float32 {
+	switch a {
+	case ReLuActivation:
+		return ReLu(x)
+	case ClippedReLuActivation:
+		return ClippedReLu(x)
+	case SquaredClippedReLuActivation:
+		return SquaredClippedReLu(x)
+	case LinearActivation:
+		return Linear(x)
+	case SigmoidActivation:
+		return Sigmoid(x)
+	}
+	panic(fmt.Sprintf("Unknown activation %d", a))
+}
+
+// Derivative returns the derivative of the activation function, it takes the
+// activated output of the neuron and not its input
+func (a Activation) Derivative(x float32) float32 {
+	switch a {
+	case ReLuActivation:
+		return ReLuPrime(x)
+	case ClippedReLuActivation:
+		return ClippedReLuPrime(x)
+	case SquaredClippedReLuActivation:
+		return SquaredClippedReLuPrime(x)
+	case LinearActivation:
+		return LinearPrime(x)
+	case SigmoidActivation:
+		return SigmoidPrime(x)
+	}
+	panic(fmt.Sprintf("Unknown activation %d", a))
+}
+
+// DefaultActivations uses ReLu for the hidden layers, and Sigmoid for the
+// output layer
+func DefaultActivations(layers int) []Activation {
+	activations := make([]Activation, layers)
+	activations[layers-1] = SigmoidActivation
+	return activations
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// FlipAugmentation trains on the color-flipped twin of every sample too
+	FlipAugmentation = false
+	// MirrorAugmentation trains on the horizontally mirrored twin of every
+	// sample without castling rights too
+	MirrorAugmentation = false
+)
+
+// ParseAugmentations enables the comma separated augmentations
+func ParseAugmentations(names string) {
+	for _, name := range strings.Split(names, ",") {
+		switch name {
+		case "flip":
+			FlipAugmentation = true
+		case "mirror":
+			MirrorAugmentation = true
+		default:
+			panic(fmt.Sprintf("Unknown augmentation %s, expected one of flip and mirror", name))
+		}
+	}
+}
+
+// Augmenting reports whether any augmentation is enabled
+func Augmenting() bool {
+	return FlipAugmentation || MirrorAugmentation
+}
+
+// CanDecode reports whether the inputs of the feature set can be decoded,
+// augmentations need to decode the inputs back into positions
+func CanDecode(features FeatureSet) bool {
+	switch f := features.(type) {
+	case *KingBucketed:
+		return f.WithKings
+	case *Factorized:
+		return CanDecode(f.Base)
+	case Decoder:
+		return true
+	}
+	return false
+}
+
+// Augment appends the sample and its twins to the batch. The position of the
+// sample is decoded from its inputs, and the twins are encoded from their
+// positions. Scores and outcomes are relative to the side to move, and the
+// color flip swaps the side to move along with the colors of the pieces, so
+// the side to move of a twin is in the same situation as the side to move of
+// the sample. The twins keep the score, outcome and weight of the sample.
+// Twins with the same inputs as the sample or as an earlier twin are dropped,
+// so that feature sets that do not tell them apart are not skewed towards
+// the augmented samples: the color flip of the perspective feature sets, and
+// the mirror of the feature sets with mirrored king buckets
+func Augment(batch []Data, sample Data, features FeatureSet) []Data {
+	batch = append(batch, sample)
+	start := len(batch) - 1
+	pos := features.(Decoder).Decode(sample.Input)
+	perspective := features.Perspective()
+	add := func(p *Position) {
+		input := features.Encode(p)
+		for _, other := range batch[start:] {
+			if sameInputs(input, other.Input, perspective) {
+				return
+			}
+		}
+		batch = append(batch, Data{Input: input, Score: sample.Score, Outcome: sample.Outcome, Weight: sample.Weight, Weighted: sample.Weighted})
+	}
+
+	if FlipAugmentation {
+		flipped := pos.FlipColors()
+		add(&flipped)
+	}
+	if MirrorAugmentation && pos.Castling == 0 {
+		mirrored := pos.Mirror()
+		add(&mirrored)
+		if FlipAugmentation {
+			both := mirrored.FlipColors()
+			add(&both)
+		}
+	}
+	return batch
+}
+
+// sameInputs reports whether the inputs have the same features regardless of
+// their order, the inputs of perspective feature sets are compared half by
+// half
+func sameInputs(a, b []int16, perspective bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := func(input []int16) []int16 {
+		sorted := append([]int16{}, input...)
+		if !perspective {
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			return sorted
+		}
+		half := len(sorted) / 2
+		first, second := sorted[:half], sorted[half:]
+		sort.Slice(first, func(i, j int) bool { return first[i] < first[j] })
+		sort.Slice(second, func(i, j int) bool { return second[i] < second[j] })
+		return sorted
+	}
+	x, y := sorted(a), sorted(b)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAugment(t *testing.T) {
+	defer func(flip, mirror bool) {
+		FlipAugmentation, MirrorAugmentation = flip, mirror
+	}(FlipAugmentation, MirrorAugmentation)
+	ParseAugmentations("flip,mirror")
+
+	features := PieceSquare{}
+	castling := ParseFen("4k3/8/8/8/8/8/4P3/4K2R w K - 0 1")
+	noCastling := ParseFen("4k3/8/8/8/8/8/4P3/4K3 b - - 0 1")
+	batch := Augment(nil, Data{Input: features.Encode(&castling), Score: 50, Outcome: 2}, features)
+	batch = Augment(batch, Data{Input: features.Encode(&noCastling), Score: -20, Outcome: 0}, features)
+
+	// Only the position without castling rights is mirrored
+	if len(batch) != 6 {
+		t.Fatalf("Expected 6 samples, got %d", len(batch))
+	}
+
+	flipped := castling.FlipColors()
+	if !sameArray16(features.Encode(&flipped), batch[1].Input) || batch[1].Score != 50 || batch[1].Outcome != 2 {
+		t.Errorf("Color-flipped twin is wrong, got %v", batch[1])
+	}
+
+	mirrored := noCastling.Mirror()
+	if !sameArray16(features.Encode(&mirrored), batch[4].Input) || batch[4].Score != -20 || batch[4].Outcome != 0 {
+		t.Errorf("Mirrored twin is wrong, got %v", batch[4])
+	}
+
+	// The perspective feature sets encode a position and its color flip the
+	// same, and the mirrored king buckets a position and its mirror too
+	distinct := map[FeatureSet]int{
+		PerspectivePieceSquare{}:                        2,
+		NewKingBucketed(NewKingBuckets(4, true), true):  1,
+		NewKingBucketed(NewKingBuckets(4, false), true): 2,
+	}
+	for features, expected := range distinct {
+		batch := Augment(nil, Data{Input: features.Encode(&noCastling), Score: -20, Outcome: 0}, features)
+		if len(batch) != expected {
+			t.Errorf("%s: expected %d distinct samples, got %d", features.Name(), expected, len(batch))
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+type (
+	// batch holds the intermediate results of a mini-batch, all the buffers
+	// are row-major with a row for each sample
+	batch struct {
+		size        int
+		activations [][]float32
+		errors      [][]float32
+		buckets     []uint32
+		offsets     []uint32
+		skip        []float32
+		// sums accumulates a column of gradients over the samples
+		sums []float32
+	}
+)
+
+// KernelBatchSize is the number of samples that go through the network
+// together, bigger batches are split into chunks of this size
+var KernelBatchSize = 256
+
+// batchBuffers returns the buffers of the mini-batch kernels, they are
+// allocated on the first use
+func (n *Network) batchBuffers() *batch {
+	if n.batch != nil && n.batch.size == KernelBatchSize {
+		return n.batch
+	}
+	b := &batch{
+		size:        KernelBatchSize,
+		activations: make([][]float32, len(n.Activations)),
+		errors:      make([][]float32, len(n.Activations)),
+		buckets:     make([]uint32, KernelBatchSize),
+		offsets:     make([]uint32, KernelBatchSize),
+		skip:        make([]float32, KernelBatchSize*int(n.Topology.Outputs)),
+	}
+	for l := 1; l < len(n.Weights); l++ {
+		if rows := int(n.Weights[l].Rows); rows > len(b.sums) {
+			b.sums = make([]float32, rows)
+		}
+	}
+	for l := range n.Activations {
+		size := KernelBatchSize * int(n.Activations[l].Size())
+		b.activations[l] = make([]float32, size)
+		b.errors[l] = make([]float32, size)
+	}
+	n.batch = b
+	return b
+}
+
+// PredictBatch predicts the outputs of all the samples, the outputs are
+// returned row-major, with a row of Topology.Outputs for each sample
+func (n *Network) PredictBatch(data []Data) []float32 {
+	outputs := int(n.Topology.Outputs)
+	result := make([]float32, len(data)*outputs)
+	last := len(n.Activations) - 1
+	for start := 0; start < len(data); start += KernelBatchSize {
+		chunk := data[start:min(start+KernelBatchSize, len(data))]
+		b := n.forwardBatch(chunk)
+		copy(result[start*outputs:], b.activations[last][:len(chunk)*outputs])
+	}
+	return result
+}
+
+// CostBatch sums the weighted cost of all the samples, without training on
+// them
+func (n *Network) CostBatch(data []Data) float32 {
+	outputs := int(n.Topology.Outputs)
+	last := len(n.Activations) - 1
+	cost := float32(0)
+	for start := 0; start < len(data); start += KernelBatchSize {
+		chunk := data[start:min(start+KernelBatchSize, len(data))]
+		b := n.forwardBatch(chunk)
+		for s, sample := range chunk {
+			output := b.activations[last][s*outputs : (s+1)*outputs]
+			cost += sample.lossWeight() * n.Cost(output, Sigmoid(float32(sample.Score)), float32(sample.Outcome)/2)
+		}
+	}
+	return cost
+}
+
+// TrainBatch is the mini-batch version of Train, it accumulates the gradients
+// of all the samples and returns the sum of their weighted costs
+func (n *Network) TrainBatch(data []Data) float32 {
+	cost := float32(0)
+	for start := 0; start < len(data); start += KernelBatchSize {
+		chunk := data[start:min(start+KernelBatchSize, len(data))]
+		b := n.forwardBatch(chunk)
+		cost += n.outputErrorsBatch(b, chunk)
+		n.backwardBatch(b, len(chunk))
+		n.updateGradientsBatch(b, chunk)
+	}
+	return cost
+}
+
+// forwardBatch is Predict over a chunk of at most KernelBatchSize samples
+func (n *Network) forwardBatch(data []Data) *batch {
+	b := n.batchBuffers()
+	outputs := int(n.Topology.Outputs)
+	perspective := n.Topology.Perspective
+
+	// First layer is sparse, and needs special care
+	weight := n.Weights[0]
+	bias := n.Biases[0].Data
+	activationFn := n.Topology.Activations[0].Apply
+	asize := int(n.Activations[0].Size())
+	for s, sample := range data {
+		output := b.activations[0][s*asize : (s+1)*asize]
+		for j := range output {
+			output[j] = 0
+		}
+		if perspective {
+			half := len(sample.Input) / 2
+			accumulate(output[:len(bias)], &weight, sample.Input[:half])
+			accumulate(output[len(bias):], &weight, sample.Input[half:])
+		} else {
+			accumulate(output, &weight, sample.Input)
+		}
+		for j := range output {
+			output[j] = activationFn(output[j] + bias[j%len(bias)])
+		}
+
+		b.buckets[s] = 0
+		if n.Topology.OutputBuckets > 1 {
+			b.buckets[s] = n.Topology.Bucket(n.FeatureSet().Pieces(sample.Input))
+		}
+		if n.Topology.PSQT {
+			n.bucket = b.buckets[s]
+			copy(b.skip[s*outputs:(s+1)*outputs], n.skipConnection(sample.Input))
+		}
+	}
+
+	// The dense layers are matrix-matrix products of the activations of the
+	// batch with the weights, each column of the weights is applied to all the
+	// samples before moving to the next one. The weights are column-major so
+	// the inner loop walks contiguous memory, the output buckets pick a part
+	// of the column for each sample
+	last := len(n.Activations) - 1
+	for l := 1; l <= last; l++ {
+		weight := n.Weights[l]
+		rows := weight.Rows
+		bias := n.Biases[l].Data
+		activationFn := n.Topology.Activations[l].Apply
+		isize := int(n.Activations[l-1].Size())
+		osize := int(n.Activations[l].Size())
+		previous := b.activations[l-1]
+		current := b.activations[l]
+		offsets := n.bucketOffsets(b, l, len(data))
+		for s := range data {
+			output := current[s*osize : (s+1)*osize]
+			copy(output, bias[offsets[s]:offsets[s]+uint32(osize)])
+			if l == last && n.Topology.PSQT {
+				skip := b.skip[s*osize : (s+1)*osize]
+				for o := range output {
+					output[o] += skip[o]
+				}
+			}
+		}
+		for i := 0; i < isize; i++ {
+			column := weight.Data[uint32(i)*rows : uint32(i+1)*rows]
+			for s := range data {
+				a := previous[s*isize+i]
+				if a == 0 {
+					continue
+				}
+				output := current[s*osize : (s+1)*osize]
+				part := column[offsets[s] : offsets[s]+uint32(osize)]
+				for o := range output {
+					output[o] += a * part[o]
+				}
+			}
+		}
+		for o := range current[:len(data)*osize] {
+			current[o] = activationFn(current[o])
+		}
+	}
+	return b
+}
+
+// bucketOffsets returns the first row of the weights and the biases of layer l
+// that each sample uses, only the last layer has output buckets
+func (n *Network) bucketOffsets(b *batch, l int, size int) []uint32 {
+	offsets := b.offsets[:size]
+	for s := range offsets {
+		offsets[s] = 0
+		if l == len(n.Activations)-1 {
+			offsets[s] = b.buckets[s] * n.Topology.Outputs
+		}
+	}
+	return offsets
+}
+
+// outputErrorsBatch computes the errors of the output layer, and returns the
+// sum of the costs. Both are scaled by the weights of the samples
+func (n *Network) outputErrorsBatch(b *batch, data []Data) float32 {
+	last := len(n.Activations) - 1
+	outputs := int(n.Topology.Outputs)
+	derivative := n.Topology.Activations[last].Derivative
+	cost := float32(0)
+	for s, sample := range data {
+		evalTarget := Sigmoid(float32(sample.Score))
+		wdlTarget := float32(sample.Outcome) / 2
+		output := b.activations[last][s*outputs : (s+1)*outputs]
+		errors := b.errors[last][s*outputs : (s+1)*outputs]
+		weight := sample.lossWeight()
+		for i, head := range n.Topology.Heads {
+			errors[i] = weight * head.Gradient(output[i], evalTarget, wdlTarget) * derivative(output[i])
+		}
+		cost += weight * n.Cost(output, evalTarget, wdlTarget)
+	}
+	return cost
+}
+
+// backwardBatch is FindErrors over a chunk of samples, the errors of the batch
+// are multiplied by the transposed weights one column at a time
+func (n *Network) backwardBatch(b *batch, size int) {
+	last := len(n.Activations) - 1
+	for l := last - 1; l >= 0; l-- {
+		weight := n.Weights[l+1]
+		rows := weight.Rows
+		derivative := n.Topology.Activations[l].Derivative
+		isize := int(n.Activations[l].Size())
+		osize := int(n.Activations[l+1].Size())
+		offsets := n.bucketOffsets(b, l+1, size)
+		for i := 0; i < isize; i++ {
+			column := weight.Data[uint32(i)*rows : uint32(i+1)*rows]
+			for s := 0; s < size; s++ {
+				d := derivative(b.activations[l][s*isize+i])
+				if d == 0 {
+					b.errors[l][s*isize+i] = 0
+					continue
+				}
+				outputError := b.errors[l+1][s*osize : (s+1)*osize]
+				part := column[offsets[s] : offsets[s]+uint32(osize)]
+				sum := float32(0)
+				for o, e := range outputError {
+					sum += e * part[o]
+				}
+				b.errors[l][s*isize+i] = sum * d
+			}
+		}
+	}
+}
+
+// updateGradientsBatch is UpdateGradients over a chunk of samples
+func (n *Network) updateGradientsBatch(b *batch, data []Data) {
+	// First layer is sparse
+	wGradients := n.WGradients[0]
+	bGradients := n.BGradients[0]
+	esize := int(n.Errors[0].Size())
+	bsize := int(bGradients.Size())
+	for s, sample := range data {
+		err := b.errors[0][s*esize : (s+1)*esize]
+		if n.Topology.Perspective {
+			half := len(sample.Input) / 2
+			updateSparseGradients(&wGradients, err[:bsize], sample.Input[:half])
+			updateSparseGradients(&wGradients, err[bsize:], sample.Input[half:])
+		} else {
+			updateSparseGradients(&wGradients, err, sample.Input)
+		}
+		for j, e := range err {
+			bGradients.Data[j%bsize].Update(e)
+		}
+	}
+
+	// The gradients of the dense layers are the products of the transposed
+	// activations with the errors of the batch, they are summed over the
+	// samples for a column at a time, and then applied once
+	last := len(n.Activations) - 1
+	for l := 1; l <= last; l++ {
+		wGradients := n.WGradients[l]
+		bGradients := n.BGradients[l]
+		rows := wGradients.Rows
+		isize := int(n.Activations[l-1].Size())
+		osize := int(n.Activations[l].Size())
+		offsets := n.bucketOffsets(b, l, len(data))
+		sums := b.sums[:rows]
+
+		for o := range sums {
+			sums[o] = 0
+		}
+		for s := range data {
+			err := b.errors[l][s*osize : (s+1)*osize]
+			part := sums[offsets[s] : offsets[s]+uint32(osize)]
+			for o, e := range err {
+				part[o] += e
+			}
+		}
+		for o, sum := range sums {
+			bGradients.Data[o].Update(sum)
+		}
+
+		for i := 0; i < isize; i++ {
+			for o := range sums {
+				sums[o] = 0
+			}
+			for s := range data {
+				a := b.activations[l-1][s*isize+i]
+				if a == 0 {
+					continue
+				}
+				err := b.errors[l][s*osize : (s+1)*osize]
+				part := sums[offsets[s] : offsets[s]+uint32(osize)]
+				for o, e := range err {
+					part[o] += a * e
+				}
+			}
+			column := wGradients.Data[uint32(i)*rows : uint32(i+1)*rows]
+			for o, sum := range sums {
+				column[o].Update(sum)
+			}
+		}
+	}
+
+	if n.Topology.PSQT {
+		outputs := int(n.Topology.Outputs)
+		for s, sample := range data {
+			n.bucket = b.buckets[s]
+			copy(n.Errors[last].Data, b.errors[last][s*outputs:(s+1)*outputs])
+			n.updateSkipGradients(sample.Input)
+		}
+	}
+}
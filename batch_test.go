@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var batchLines = []string{
+	"5k2/ppp5/4P3/3R3p/6P1/1K2Nr2/PP3P2/8 b - - 1 32;score:-72;eval:50;qs:0;outcome:0.5",
+	"rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 1;score:30;eval:30;qs:0;outcome:1.0",
+	"8/8/4k3/8/8/3K4/4P3/8 w - - 0 1;score:150;eval:150;qs:0;outcome:1.0",
+	"r1bqkb1r/pppp1ppp/2n2n2/4p3/2B1P3/5N2/PPPP1PPP/RNBQK2R w KQkq - 4 4;score:-20;eval:-20;qs:0;outcome:0.0",
+	"8/5k2/8/8/8/8/2K5/8 w - - 0 1;score:0;eval:0;qs:0;outcome:0.5",
+	"6k1/5ppp/8/8/8/8/5PPP/3R2K1 w - - 0 1;score:400;eval:400;qs:0;outcome:1.0",
+	"4k3/8/8/8/8/8/8/4KQ2 b - - 0 1;score:-900;eval:-900;qs:0;outcome:0.0",
+}
+
+func compareBatchTraining(t *testing.T, top Topology, data []Data) {
+	defer func(size int) { KernelBatchSize = size }(KernelBatchSize)
+	// A small kernel batch makes sure that batches are split into chunks
+	KernelBatchSize = 3
+
+	SeedRandom(7)
+	net := CreateNetwork(top, 30)
+	single := net.Copy()
+	batched := net.Copy()
+
+	cost := float32(0)
+	outputs := make([]float32, 0)
+	for _, sample := range data {
+		outputs = append(outputs, single.Predict(sample.Input)...)
+		cost += single.TrainWeighted(sample.Input, Sigmoid(float32(sample.Score)), float32(sample.Outcome)/2, sample.lossWeight())
+	}
+
+	if predicted := batched.PredictBatch(data); !sameApproxArray(outputs, predicted) {
+		t.Errorf(fmt.Sprintf("Got %v, Expected %v", predicted, outputs))
+	}
+	if batchCost := batched.TrainBatch(data); math.Abs(float64(cost-batchCost)) > 1e-5 {
+		t.Errorf("Got cost %f, Expected %f", batchCost, cost)
+	}
+	for l := range net.Activations {
+		if !sameApproxArray(single.WGradients[l].Values(), batched.WGradients[l].Values()) {
+			t.Errorf("Weight gradients of layer %d differ", l)
+		}
+		if !sameApproxArray(single.BGradients[l].Values(), batched.BGradients[l].Values()) {
+			t.Errorf("Bias gradients of layer %d differ", l)
+		}
+	}
+	if top.PSQT && !sameApproxArray(single.PSQTGradients.Values(), batched.PSQTGradients.Values()) {
+		t.Errorf("PSQT gradients differ")
+	}
+}
+
+func TestTrainBatch(t *testing.T) {
+	data := make([]Data, len(batchLines))
+	for i, line := range batchLines {
+		data[i] = ParseLine(line)
+	}
+
+	top := NewTopology(769, 2, []uint32{16, 8})
+	top.OutputBuckets = 4
+	top.PSQT = true
+	top.Heads = []OutputHead{{Target: EvalTarget}, {Target: WDLTarget, Loss: CrossEntropy}}
+	compareBatchTraining(t, top, data)
+}
+
+func TestTrainBatchWeighted(t *testing.T) {
+	data := make([]Data, len(batchLines))
+	for i, line := range batchLines {
+		data[i] = ParseLine(line)
+		data[i].setWeight(0.25 * float32(i+1))
+	}
+
+	top := NewTopology(769, 1, []uint32{16})
+	compareBatchTraining(t, top, data)
+}
+
+func TestTrainBatchPerspective(t *testing.T) {
+	data := []Data{
+		{Input: []int16{0, 2, 3, 1, 5, 6}, Score: 10, Outcome: 2},
+		{Input: []int16{1, 4, 7, 0}, Score: -40, Outcome: 0},
+		{Input: []int16{2, 3, 5, 6, 7, 1, 2, 4, 5, 6}, Score: 0, Outcome: 1},
+		{Input: []int16{7, 6}, Score: 80, Outcome: 2},
+	}
+
+	top := NewTopology(8, 1, []uint32{4, 2})
+	top.Perspective = true
+	top.PSQT = true
+	compareBatchTraining(t, top, data)
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// The binpack v1 format is:
+//   - 8 bytes (uint64) number of samples
+//   - For each sample 4 bytes outcome, 4 bytes score, 4 bytes number of
+//     features and 4 bytes for each feature, only the lower 2 bytes of each
+//     field are used
+//
+// The binpack v2 format is:
+//   - 4 bytes magic (BinpackMagic), 4 bytes (uint32) version, 4 bytes
+//     (uint32) flags and 8 bytes (uint64) number of samples
+//   - Blocks of samples until the end of the file, each block starts with 4
+//     bytes (uint32) size of the block and 4 bytes (uint32) number of samples
+//     in the block. The block is compressed with flate when the compressed
+//     flag is set
+//   - When the tagged flag is set, 1 byte length and the name of the feature
+//     set of the features, and 4 bytes (uint32) number of its inputs
+//   - For each sample 1 byte outcome, 2 bytes score, a uvarint number of
+//     features and a varint for each feature, that is the difference from the
+//     previous feature (or from zero for the first one). When the highest bit
+//     of the outcome (weightedSample) is set, 4 bytes (float32) weight follow
+//     the score
+//
+// The binpack v3 format is the v2 format, where every sample stores its
+// position instead of its features, so that the features are derived with the
+// feature set that is used when the binpack is loaded:
+//   - For each sample 1 byte outcome, 2 bytes score and the optional weight
+//     like v2, 8 bytes (uint64) occupancy of the board, where bit i is square
+//     i, 4 bits for the piece on each occupied square in the order of the
+//     squares (the low nibble first), 1 byte side to move (bit 0) and castling
+//     rights (bits 1 to 4), 1 byte en passant square (64 when there is none)
+//     and a uvarint half move clock and full move number. Both clocks are 0
+//     when they are not known
+//
+// All numbers are little endian
+
+type (
+	// binpackReader reads the samples of binpack files of any version
+	binpackReader struct {
+		paths   []string
+		file    io.ReadCloser
+		reader  *bufio.Reader
+		version uint32
+		flags   uint32
+		// samples is the number of samples left in a v1 file, or in the
+		// current block of a v2 or v3 file
+		samples uint64
+		block   *bytes.Reader
+		path    string
+		// position is the position of the last sample, it is only known in
+		// v3 files
+		position *Position
+		skipped  map[string]int
+		// positionsOnly does not encode the positions of v3 files, their
+		// samples have no inputs
+		positionsOnly bool
+	}
+
+	// BinpackWriter writes binpack v2 and v3 files
+	BinpackWriter struct {
+		file         *os.File
+		writer       *bufio.Writer
+		version      uint32
+		flags        uint32
+		samples      uint64
+		block        bytes.Buffer
+		blockSamples uint32
+		buf          []byte
+	}
+)
+
+const (
+	BinpackMagic = "ZBPK"
+	// BinpackVersion is the version of binpacks that store positions
+	BinpackVersion = 3
+	// FeatureBinpackVersion is the version of binpacks that store features
+	FeatureBinpackVersion = 2
+
+	// CompressedBinpack is the flag of binpacks with flate compressed blocks
+	CompressedBinpack uint32 = 1
+	// TaggedBinpack is the flag of binpacks v2 that record their feature set
+	TaggedBinpack uint32 = 2
+
+	// binpackBlockSize is the number of samples in a block of a binpack v2
+	// or v3
+	binpackBlockSize = 16384
+	// binpackHeaderSize is the size of the header of a binpack v2 or v3
+	binpackHeaderSize = 20
+	// weightedSample marks the outcomes of the samples of a binpack v2 or v3
+	// that have a weight
+	weightedSample = 0x80
+)
+
+// CompressBinpacks compresses the blocks of the binpacks that are written
+var CompressBinpacks = false
+
+func (r *binpackReader) Read() (Data, bool) {
+	for {
+		if r.reader == nil {
+			if len(r.paths) == 0 {
+				return Data{}, false
+			}
+			r.open(r.paths[0])
+			r.paths = r.paths[1:]
+		}
+
+		r.position = nil
+		if r.version == 1 {
+			if r.samples == 0 {
+				r.Close()
+				continue
+			}
+			r.samples--
+			if sample := readBinpackSample(r.reader); r.validInputs(&sample) && keepSample(&sample, nil) {
+				return sample, true
+			}
+			continue
+		}
+
+		if r.samples == 0 && !r.nextBlock() {
+			r.Close()
+			continue
+		}
+		r.samples--
+		if r.version == FeatureBinpackVersion {
+			if sample := readCompactSample(r.block); r.validInputs(&sample) && keepSample(&sample, nil) {
+				return sample, true
+			}
+			continue
+		}
+
+		sample := readSampleHeader(r.block)
+		pos := readPackedPosition(r.block)
+		if !r.positionsOnly {
+			input, err := encode(&pos)
+			if err != nil {
+				if StrictParsing {
+					panic(fmt.Sprintf("%s: %s", r.path, err))
+				}
+				r.skipped[BadPosition]++
+				continue
+			}
+			sample.Input = input
+		}
+		if keepSample(&sample, &pos) {
+			r.position = &pos
+			return sample, true
+		}
+	}
+}
+
+// Position returns the position of the last sample, or nil when the binpack
+// stores features
+func (r *binpackReader) Position() *Position {
+	return r.position
+}
+
+// open reads the header of the file, binpacks that do not start with the
+// magic are v1 binpacks
+func (r *binpackReader) open(path string) {
+	file := openInput(path)
+	r.file = file
+	r.reader = bufio.NewReader(file)
+	r.path = path
+	if r.skipped == nil {
+		r.skipped = make(map[string]int)
+	}
+
+	magic, err := r.reader.Peek(len(BinpackMagic))
+	if err != nil || string(magic) != BinpackMagic {
+		r.version = 1
+		r.samples = readBinpackHeader(r.reader)
+		return
+	}
+
+	header := make([]byte, binpackHeaderSize)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		panic(err)
+	}
+	r.version = binary.LittleEndian.Uint32(header[4:])
+	r.flags = binary.LittleEndian.Uint32(header[8:])
+	r.samples = 0
+	if r.version != BinpackVersion && r.version != FeatureBinpackVersion {
+		panic(fmt.Sprintf("Unsupported binpack version %d of %s", r.version, path))
+	}
+	if r.flags&TaggedBinpack != 0 {
+		name, size := readFeatureTag(r.reader)
+		if name != Features.Name() || size != Features.Size() {
+			panic(fmt.Sprintf("%s stores the features of %s with %d inputs, they can not be loaded as %s with %d inputs",
+				path, name, size, Features.Name(), Features.Size()))
+		}
+	}
+}
+
+// validInputs reports whether the features of a sample of a binpack of
+// features are inputs of the feature set, in strict mode it panics otherwise
+func (r *binpackReader) validInputs(sample *Data) bool {
+	for _, feature := range sample.Input {
+		if feature < 0 || uint32(feature) >= Features.Size() {
+			err := &ParseError{BadInput, fmt.Sprintf("input %d is not one of the %d inputs of %s", feature, Features.Size(), Features.Name())}
+			if StrictParsing {
+				panic(fmt.Sprintf("%s: %s", r.path, err))
+			}
+			r.skipped[BadInput]++
+			return false
+		}
+	}
+	return true
+}
+
+func readFeatureTag(reader io.Reader) (string, uint32) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		panic(err)
+	}
+	tag := make([]byte, int(length[0])+4)
+	if _, err := io.ReadFull(reader, tag); err != nil {
+		panic(err)
+	}
+	return string(tag[:length[0]]), binary.LittleEndian.Uint32(tag[length[0]:])
+}
+
+// nextBlock reads the next block of a v2 or v3 file, and returns false at the end
+// of the file
+func (r *binpackReader) nextBlock() bool {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r.reader, header); errors.Is(err, io.EOF) {
+		return false
+	} else if err != nil {
+		panic(err)
+	}
+	size := binary.LittleEndian.Uint32(header)
+	r.samples = uint64(binary.LittleEndian.Uint32(header[4:]))
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		panic(err)
+	}
+	if r.flags&CompressedBinpack != 0 {
+		inflater := flate.NewReader(bytes.NewReader(payload))
+		decompressed, err := io.ReadAll(inflater)
+		if err != nil {
+			panic(err)
+		}
+		inflater.Close()
+		payload = decompressed
+	}
+	r.block = bytes.NewReader(payload)
+	return true
+}
+
+// Skipped returns the number of positions of v3 files that can not be
+// encoded with the feature set
+func (r *binpackReader) Skipped() map[string]int {
+	return r.skipped
+}
+
+func (r *binpackReader) Close() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = nil
+	r.reader = nil
+	r.block = nil
+}
+
+func readBinpackHeader(reader io.Reader) uint64 {
+	buf8 := make([]byte, 8)
+	_, err := io.ReadFull(reader, buf8)
+	if err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buf8)
+}
+
+// readBinpackSample reads a sample of a v1 binpack
+func readBinpackSample(reader io.Reader) Data {
+	var buf4 = make([]byte, 4)
+	_, err := io.ReadFull(reader, buf4)
+	if err != nil {
+		panic(err)
+	}
+	outcome := int8(binary.LittleEndian.Uint16(buf4))
+	_, err = io.ReadFull(reader, buf4)
+	if err != nil {
+		panic(err)
+	}
+	score := int16(binary.LittleEndian.Uint16(buf4))
+	_, err = io.ReadFull(reader, buf4)
+	if err != nil {
+		panic(err)
+	}
+	inputLength := binary.LittleEndian.Uint16(buf4)
+	input := make([]int16, inputLength)
+	for j := uint16(0); j < inputLength; j++ {
+		_, err = io.ReadFull(reader, buf4)
+		if err != nil {
+			panic(err)
+		}
+		input[j] = int16(binary.LittleEndian.Uint16(buf4))
+	}
+
+	return Data{
+		Score:   score,
+		Outcome: outcome,
+		Input:   input,
+	}
+}
+
+// readSampleHeader reads the outcome, the score and the weight of a sample of
+// a v2 or v3 binpack
+func readSampleHeader(reader *bytes.Reader) Data {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		panic(err)
+	}
+	sample := Data{
+		Outcome: int8(header[0] &^ weightedSample),
+		Score:   int16(binary.LittleEndian.Uint16(header[1:])),
+	}
+	if header[0]&weightedSample != 0 {
+		weight := make([]byte, 4)
+		if _, err := io.ReadFull(reader, weight); err != nil {
+			panic(err)
+		}
+		sample.setWeight(math.Float32frombits(binary.LittleEndian.Uint32(weight)))
+	}
+	return sample
+}
+
+// readCompactSample reads a sample of a v2 binpack
+func readCompactSample(reader *bytes.Reader) Data {
+	sample := readSampleHeader(reader)
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		panic(err)
+	}
+	input := make([]int16, length)
+	previous := int64(0)
+	for j := range input {
+		delta, err := binary.ReadVarint(reader)
+		if err != nil {
+			panic(err)
+		}
+		previous += delta
+		input[j] = int16(previous)
+	}
+
+	sample.Input = input
+	return sample
+}
+
+// readPackedPosition reads the position of a sample of a v3 binpack
+func readPackedPosition(reader *bytes.Reader) Position {
+	pos := emptyPosition()
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		panic(err)
+	}
+	occupancy := binary.LittleEndian.Uint64(buf)
+	pieces := make([]byte, (bits.OnesCount64(occupancy)+1)/2)
+	if _, err := io.ReadFull(reader, pieces); err != nil {
+		panic(err)
+	}
+	i := 0
+	for sq := range pos.Board {
+		if occupancy&(1<<sq) == 0 {
+			continue
+		}
+		p := Piece(pieces[i/2] >> (4 * (i % 2)) & 0xf)
+		if p >= NoPiece {
+			panic(fmt.Sprintf("Invalid piece %d in a binpack", p))
+		}
+		pos.Board[sq] = p
+		i++
+	}
+
+	if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+		panic(err)
+	}
+	pos.SideToMove = Color(buf[0] & 1)
+	pos.Castling = PositionTag(buf[0] >> 1 & 0xf)
+	pos.EnPassant = Square(buf[1])
+	if pos.EnPassant > NoSquare {
+		panic(fmt.Sprintf("Invalid en passant square %d in a binpack", pos.EnPassant))
+	}
+	halfMoveClock, err := binary.ReadUvarint(reader)
+	if err != nil {
+		panic(err)
+	}
+	fullMoveNumber, err := binary.ReadUvarint(reader)
+	if err != nil {
+		panic(err)
+	}
+	if fullMoveNumber != 0 {
+		pos.HalfMoveClock = uint16(halfMoveClock)
+		pos.FullMoveNumber = uint16(fullMoveNumber)
+		pos.HasClocks = true
+	}
+	return pos
+}
+
+// CreateBinpack creates a binpack v3 file, that stores the positions of the
+// samples. The blocks are compressed when CompressBinpacks is set
+func CreateBinpack(path string) *BinpackWriter {
+	return createBinpack(path, BinpackVersion)
+}
+
+// CreateFeatureBinpack creates a binpack v2 file, that stores the features of
+// the samples, for samples whose positions are not known
+func CreateFeatureBinpack(path string) *BinpackWriter {
+	return createBinpack(path, FeatureBinpackVersion)
+}
+
+func createBinpack(path string, version uint32) *BinpackWriter {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	w := &BinpackWriter{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		version: version,
+		buf:     make([]byte, binary.MaxVarintLen64),
+	}
+	if CompressBinpacks {
+		w.flags |= CompressedBinpack
+	}
+	if version == FeatureBinpackVersion {
+		w.flags |= TaggedBinpack
+	}
+	// The number of samples is only known when the file is closed
+	w.writeHeader()
+	if version == FeatureBinpackVersion {
+		w.writeFeatureTag()
+	}
+	return w
+}
+
+// writeFeatureTag records Features, that encoded the features of the samples
+func (w *BinpackWriter) writeFeatureTag() {
+	name := Features.Name()
+	tag := append([]byte{byte(len(name))}, name...)
+	tag = append(tag, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(tag[len(tag)-4:], Features.Size())
+	if _, err := w.writer.Write(tag); err != nil {
+		panic(err)
+	}
+}
+
+func (w *BinpackWriter) writeHeader() {
+	header := make([]byte, binpackHeaderSize)
+	copy(header, BinpackMagic)
+	binary.LittleEndian.PutUint32(header[4:], w.version)
+	binary.LittleEndian.PutUint32(header[8:], w.flags)
+	binary.LittleEndian.PutUint64(header[12:], w.samples)
+	if _, err := w.writer.Write(header); err != nil {
+		panic(err)
+	}
+}
+
+// Write appends the sample to the current block, the position is only needed
+// by binpacks of positions
+func (w *BinpackWriter) Write(sample Data, pos *Position) {
+	outcome := byte(sample.Outcome)
+	if sample.Weighted {
+		outcome |= weightedSample
+	}
+	w.block.WriteByte(outcome)
+	binary.LittleEndian.PutUint16(w.buf, uint16(sample.Score))
+	w.block.Write(w.buf[:2])
+	if sample.Weighted {
+		binary.LittleEndian.PutUint32(w.buf, math.Float32bits(sample.Weight))
+		w.block.Write(w.buf[:4])
+	}
+	if w.version == BinpackVersion {
+		if pos == nil {
+			panic("The position of every sample is needed by binpacks of positions")
+		}
+		w.writePosition(pos)
+	} else {
+		w.block.Write(w.buf[:binary.PutUvarint(w.buf, uint64(len(sample.Input)))])
+		previous := int64(0)
+		for _, feature := range sample.Input {
+			w.block.Write(w.buf[:binary.PutVarint(w.buf, int64(feature)-previous)])
+			previous = int64(feature)
+		}
+	}
+
+	w.samples++
+	w.blockSamples++
+	if w.blockSamples == binpackBlockSize {
+		w.flushBlock()
+	}
+}
+
+// writePosition packs the position of a sample of a v3 binpack
+func (w *BinpackWriter) writePosition(pos *Position) {
+	occupancy := uint64(0)
+	for sq, p := range pos.Board {
+		if p != NoPiece {
+			occupancy |= 1 << sq
+		}
+	}
+	binary.LittleEndian.PutUint64(w.buf, occupancy)
+	w.block.Write(w.buf[:8])
+
+	packed, half := byte(0), false
+	for _, p := range pos.Board {
+		if p == NoPiece {
+			continue
+		}
+		if half {
+			w.block.WriteByte(packed | byte(p)<<4)
+		} else {
+			packed = byte(p)
+		}
+		half = !half
+	}
+	if half {
+		w.block.WriteByte(packed)
+	}
+
+	w.block.WriteByte(byte(pos.SideToMove) | byte(pos.Castling)<<1)
+	w.block.WriteByte(byte(pos.EnPassant))
+	halfMoveClock, fullMoveNumber := uint64(pos.HalfMoveClock), uint64(pos.FullMoveNumber)
+	if !pos.HasClocks {
+		halfMoveClock, fullMoveNumber = 0, 0
+	}
+	w.block.Write(w.buf[:binary.PutUvarint(w.buf, halfMoveClock)])
+	w.block.Write(w.buf[:binary.PutUvarint(w.buf, fullMoveNumber)])
+}
+
+func (w *BinpackWriter) flushBlock() {
+	if w.blockSamples == 0 {
+		return
+	}
+	payload := w.block.Bytes()
+	if w.flags&CompressedBinpack != 0 {
+		var compressed bytes.Buffer
+		deflater, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := deflater.Write(payload); err != nil {
+			panic(err)
+		}
+		if err := deflater.Close(); err != nil {
+			panic(err)
+		}
+		payload = compressed.Bytes()
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], w.blockSamples)
+	if _, err := w.writer.Write(header); err != nil {
+		panic(err)
+	}
+	if _, err := w.writer.Write(payload); err != nil {
+		panic(err)
+	}
+	w.block.Reset()
+	w.blockSamples = 0
+}
+
+// Close writes the last block and the number of samples
+func (w *BinpackWriter) Close() {
+	w.flushBlock()
+	if err := w.writer.Flush(); err != nil {
+		panic(err)
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+	w.writer.Reset(w.file)
+	w.writeHeader()
+	if err := w.writer.Flush(); err != nil {
+		panic(err)
+	}
+	if err := w.file.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// binpackSamples returns the number of samples of a binpack of any version
+func binpackSamples(path string) uint64 {
+	_, samples := binpackHeader(path)
+	return samples
+}
+
+// binpackHeader returns the version and the number of samples of a binpack
+func binpackHeader(path string) (uint32, uint64) {
+	f := openInput(path)
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	magic, err := reader.Peek(len(BinpackMagic))
+	if err != nil || string(magic) != BinpackMagic {
+		return 1, readBinpackHeader(reader)
+	}
+	header := make([]byte, binpackHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint32(header[4:]), binary.LittleEndian.Uint64(header[12:])
+}
+
+// outputBinpacks returns the constructor of the binpacks that store the
+// samples of the inputs, binpacks of positions unless some of the inputs are
+// binpacks of features, whose positions are not known. It also returns
+// whether positions are stored, their samples need no inputs then
+func outputBinpacks(inputs []string) (func(path string) *BinpackWriter, bool) {
+	for _, input := range inputs {
+		if !isBinpack(input) {
+			continue
+		}
+		if version, _ := binpackHeader(input); version != BinpackVersion {
+			fmt.Printf("%s has no positions, so the features are stored instead\n", input)
+			return CreateFeatureBinpack, false
+		}
+	}
+	return CreateBinpack, true
+}
+
+// SaveDataset converts the text and binpack inputs into a single binpack, of
+// positions when they are known and of features otherwise. Positions are
+// stored as they are, they are only encoded when they are loaded. The
+// repeated positions are removed according to Deduplication. Passing a
+// binpack as the only input deduplicates it into a new binpack
+func SaveDataset(paths string, file string) {
+	inputs := ExpandPaths(paths)
+	create, positions := outputBinpacks(inputs)
+	reader := openSamples(inputs)
+	if positions {
+		reader = openPositions(inputs)
+	}
+	defer reader.Close()
+	storeSamples(reader, create(file))
+}
+
+// storeSamples writes all the samples of the reader, deduplicated with the
+// Deduplication policy
+func storeSamples(reader sampleReader, writer *BinpackWriter) {
+	var duplicates *deduplicator
+	if Deduplication != KeepDuplicates {
+		duplicates = newDeduplicator(Deduplication)
+	}
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		if duplicates != nil && (!duplicates.Add(sample, reader.Position()) || Deduplication != KeepFirst) {
+			// Averaged samples are only written once all of them are read
+			continue
+		}
+		writer.Write(sample, reader.Position())
+		if writer.samples%100_000 == 0 {
+			fmt.Printf("%d samples are stored\r", writer.samples)
+		}
+	}
+	if duplicates != nil {
+		samples, positions := duplicates.Samples()
+		for i, sample := range samples {
+			writer.Write(sample, positions[i])
+		}
+	}
+	writer.Close()
+	fmt.Printf("%d samples are stored\n", writer.samples)
+	printSkipped(reader.Skipped())
+	printFiltered()
+	if duplicates != nil {
+		duplicates.printDuplicates()
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func binpackSamplesForTest() []Data {
+	lines := []string{
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1;score:342;eval:351;qs:351;outcome:1.0",
+		"5k2/ppp5/4P3/3R3p/6P1/1K2Nr2/PP3P2/8 b - - 1 32;score:-72;eval:50;qs:0;outcome:0.5",
+		"8/8/4k3/8/8/3K4/4P3/8 w - - 0 1;score:-32000;eval:150;qs:0;outcome:0.0",
+	}
+	data := make([]Data, 0)
+	for i := 0; i < 20000; i++ {
+		data = append(data, ParseLine(lines[i%len(lines)]))
+	}
+	return data
+}
+
+// loadBinpack loads all the samples of the binpack, without weighing them
+func loadBinpack(path string) []Data {
+	reader := &binpackReader{paths: []string{path}}
+	defer reader.Close()
+
+	data := make([]Data, 0, binpackSamples(path))
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		data = append(data, sample)
+	}
+	printFiltered()
+
+	return data
+}
+
+// writeBinpackSample writes a sample of a v1 binpack
+func writeBinpackSample(writer io.Writer, sample Data) {
+	var buf4 = make([]byte, 4)
+	write := func(value uint16) {
+		binary.LittleEndian.PutUint16(buf4, value)
+		_, err := writer.Write(buf4)
+		if err != nil {
+			panic(err)
+		}
+	}
+	write(uint16(sample.Outcome))
+	write(uint16(sample.Score))
+	write(uint16(len(sample.Input)))
+	for _, i := range sample.Input {
+		write(uint16(i))
+	}
+}
+
+func sameSamples(t *testing.T, expected, actual []Data) {
+	if len(expected) != len(actual) {
+		t.Fatalf("Expected %d samples, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i].Score != actual[i].Score || expected[i].Outcome != actual[i].Outcome || !sameArray16(expected[i].Input, actual[i].Input) {
+			t.Fatalf("Sample %d is %v, expected %v", i, actual[i], expected[i])
+		}
+	}
+}
+
+func TestBinpackV2(t *testing.T) {
+	defer func(compress bool) { CompressBinpacks = compress }(CompressBinpacks)
+	data := binpackSamplesForTest()
+
+	sizes := make([]int64, 2)
+	for i, compress := range []bool{false, true} {
+		CompressBinpacks = compress
+		path := filepath.Join(t.TempDir(), "dataset.bin")
+		writer := CreateFeatureBinpack(path)
+		for _, sample := range data {
+			writer.Write(sample, nil)
+		}
+		writer.Close()
+
+		if binpackSamples(path) != uint64(len(data)) {
+			t.Errorf("Header has %d samples, expected %d", binpackSamples(path), len(data))
+		}
+		sameSamples(t, data, loadBinpack(path))
+		info, _ := os.Stat(path)
+		sizes[i] = info.Size()
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("Compressed binpack is %d bytes, while the uncompressed one is %d", sizes[1], sizes[0])
+	}
+}
+
+func TestConvertBinpack(t *testing.T) {
+	data := binpackSamplesForTest()
+
+	v1 := filepath.Join(t.TempDir(), "v1.bin")
+	f, err := os.Create(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := bufio.NewWriter(f)
+	buf8 := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf8, uint64(len(data)))
+	writer.Write(buf8)
+	for _, sample := range data {
+		writeBinpackSample(writer, sample)
+	}
+	writer.Flush()
+	f.Close()
+	sameSamples(t, data, loadBinpack(v1))
+
+	v2 := filepath.Join(t.TempDir(), "v2.bin")
+	SaveDataset(v1, v2)
+	sameSamples(t, data, loadBinpack(v2))
+
+	v1Info, _ := os.Stat(v1)
+	v2Info, _ := os.Stat(v2)
+	if 2*v2Info.Size() > v1Info.Size() {
+		t.Errorf("Binpack v2 is %d bytes, expected less than half of the %d bytes of v1", v2Info.Size(), v1Info.Size())
+	}
+}
+
+func TestBinpackV3(t *testing.T) {
+	defer func(features FeatureSet) { Features = features }(Features)
+	Features = PieceSquare{}
+
+	fens := []string{
+		"rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1",
+		"r3k2r/8/8/8/8/8/8/R3K2R w Kq - 12 40",
+		"8/8/4k3/8/8/3K4/4P3/8 w - - 0 1",
+		"8/8/8/8/8/8/8/8 b - - 99 300",
+		"8/8/4k3/8/8/3K4/4P3/8 b - -",
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "positions.bin")
+	writer := CreateBinpack(path)
+	for i, fen := range fens {
+		pos := ParseFen(fen)
+		writer.Write(Data{Score: int16(i), Outcome: 2, Weight: float32(i), Weighted: true}, &pos)
+	}
+	writer.Close()
+
+	reader := &binpackReader{paths: []string{path}}
+	for i, fen := range fens {
+		sample, ok := reader.Read()
+		if !ok {
+			t.Fatalf("Expected %d samples, got %d", len(fens), i)
+		}
+		expected := ParseFen(fen)
+		if pos := reader.Position(); pos == nil || *pos != expected {
+			t.Errorf("Expected the position of %s, got %v", fen, pos)
+		}
+		if sample.Score != int16(i) || sample.Outcome != 2 || sample.lossWeight() != float32(i) || !sameFeatures(FromFen(fen), sample.Input) {
+			t.Errorf("Sample %d is %v", i, sample)
+		}
+	}
+	reader.Close()
+
+	// The features are derived with the feature set that is used to load the
+	// binpack
+	text := filepath.Join(dir, "dataset.epd")
+	lines := "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1;score:30;eval:30;qs:0;outcome:1.0\n" +
+		"r3k2r/8/8/8/8/8/8/R3K2R w Kq - 12 40;score:-20;eval:0;qs:0;outcome:0.5\n"
+	if err := os.WriteFile(text, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	binpack := filepath.Join(dir, "dataset.bin")
+	SaveDataset(text, binpack)
+	for _, features := range []FeatureSet{PieceSquare{}, PerspectivePieceSquare{}, NewKingBucketed(NewKingBuckets(32, true), true)} {
+		Features = features
+		sameSamples(t, LoadDataset(text), loadBinpack(binpack))
+	}
+}
+
+func TestSaveUnencodablePositions(t *testing.T) {
+	defer func(features FeatureSet) { Features = features }(Features)
+	defer func(strict bool) { StrictParsing = strict }(StrictParsing)
+
+	// Binpacks of positions keep the positions that the feature set can not
+	// encode, they are only dropped when the binpack is loaded with it
+	dir := t.TempDir()
+	text := filepath.Join(dir, "dataset.epd")
+	lines := "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5\n" +
+		"8/8/8/8/8/8/4P3/8 w - - 0 1;score:20;eval:0;qs:0;outcome:0.5\n"
+	if err := os.WriteFile(text, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	binpack := filepath.Join(dir, "dataset.bin")
+	StrictParsing = false
+	Features = NewKingBucketed(NewKingBuckets(4, true), false)
+	SaveDataset(text, binpack)
+
+	Features = PieceSquare{}
+	if data := loadBinpack(binpack); len(data) != 2 || data[1].Score != 20 {
+		t.Errorf("Expected both positions to be stored, got %v", data)
+	}
+	Features = NewKingBucketed(NewKingBuckets(4, true), false)
+	if data := loadBinpack(binpack); len(data) != 1 || data[0].Score != 10 {
+		t.Errorf("Expected the position without kings to be skipped, got %v", data)
+	}
+}
+
+func TestBinpackFeatureSet(t *testing.T) {
+	defer func(features FeatureSet) { Features = features }(Features)
+	defer func(strict bool) { StrictParsing = strict }(StrictParsing)
+	dir := t.TempDir()
+
+	// Binpacks v2 record their feature set, and can not be loaded with
+	// another one
+	Features = PieceSquare{}
+	v2 := filepath.Join(dir, "v2.bin")
+	writer := CreateFeatureBinpack(v2)
+	writer.Write(Data{Input: []int16{1, 768}, Score: 5}, nil)
+	writer.Close()
+	if data := loadBinpack(v2); len(data) != 1 || data[0].Score != 5 {
+		t.Errorf("Expected the sample of the binpack, got %v", data)
+	}
+	func() {
+		Features = PerspectivePieceSquare{}
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected the binpack of another feature set to be rejected")
+			}
+		}()
+		loadBinpack(v2)
+	}()
+
+	// Binpacks v1 do not, their inputs are checked instead
+	Features = PieceSquare{}
+	v1 := filepath.Join(dir, "v1.bin")
+	f, err := os.Create(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf8 := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf8, 2)
+	f.Write(buf8)
+	writeBinpackSample(f, Data{Input: []int16{1, 768}, Score: 5})
+	writeBinpackSample(f, Data{Input: []int16{1, 900}, Score: 6})
+	f.Close()
+
+	StrictParsing = false
+	reader := &binpackReader{paths: []string{v1}}
+	data := make([]Data, 0)
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		data = append(data, sample)
+	}
+	reader.Close()
+	if len(data) != 1 || data[0].Score != 5 || reader.Skipped()[BadInput] != 1 {
+		t.Errorf("Expected the sample with an input out of range to be skipped, got %v and %v", data, reader.Skipped())
+	}
+
+	StrictParsing = true
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Expected an input out of range to be rejected in strict mode")
+		}
+	}()
+	loadBinpack(v1)
+}
@@ -2,46 +2,117 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// Features is the feature set that is used when loading datasets, it has to
+// match the topology of the network that is being trained
+var Features FeatureSet = PieceSquare{}
+
 type (
 	Data struct {
 		Input   []int16
 		Score   int16
 		Outcome int8
+		// Weight scales the gradient and the cost of the sample, it is only
+		// set when Weighted is, the other samples weigh 1
+		Weight   float32
+		Weighted bool
+	}
+
+	// ParseError is a line of a text dataset that can not be parsed, the
+	// category groups similar errors in the summary of skipped lines
+	ParseError struct {
+		Category string
+		Reason   string
 	}
 )
 
+// The categories of parse errors
+const (
+	EmptyLine    = "empty line"
+	LongLine     = "line too long"
+	MissingField = "missing field"
+	BadFen       = "bad FEN"
+	BadScore     = "bad score"
+	BadOutcome   = "bad outcome"
+	BadWeight    = "bad weight"
+	BadPosition  = "unencodable position"
+	BadInput     = "input out of range"
+)
+
+// StrictParsing stops at the first line that can not be parsed, otherwise
+// such lines are skipped and counted
+var StrictParsing = true
+
+func (e *ParseError) Error() string {
+	return e.Category + ": " + e.Reason
+}
+
+// printSkipped prints the number of skipped lines of each category
+func printSkipped(skipped map[string]int) {
+	if len(skipped) == 0 {
+		return
+	}
+	categories := make([]string, 0, len(skipped))
+	total := 0
+	for category, count := range skipped {
+		categories = append(categories, category)
+		total += count
+	}
+	sort.Strings(categories)
+	fmt.Printf("Skipped %d lines that could not be parsed:\n", total)
+	for _, category := range categories {
+		fmt.Printf("  %s: %d\n", category, skipped[category])
+	}
+}
+
 func countSamples(paths []string) int64 {
 	fmt.Printf("Paths to load %s\n", paths)
 	totalCount := int64(0)
-	countLines := func(f *os.File) int64 {
+	countLines := func(f io.Reader) int64 {
 		count := int64(0)
-		input := bufio.NewScanner(f)
-		for input.Scan() {
-			count++
-			if err := input.Err(); err != nil {
+		buf := make([]byte, 1<<16)
+		last := byte('\n')
+		for {
+			n, err := f.Read(buf)
+			count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			if n > 0 {
+				last = buf[n-1]
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
 				panic(err)
 			}
 		}
+		if last != '\n' {
+			// The last line has no line break
+			count++
+		}
 
 		return count
 	}
 	for _, path := range paths {
-		file, err := os.Open(path)
-		if err != nil {
-			panic(err)
+		if isBinpack(path) {
+			totalCount += int64(binpackSamples(path))
+			continue
 		}
-		defer file.Close()
+		file := openInput(path)
 		totalCount += countLines(file)
+		file.Close()
 	}
 
 	fmt.Printf("Loading %d samples\n", totalCount)
@@ -49,224 +120,672 @@ func countSamples(paths []string) int64 {
 	return totalCount
 }
 
-func SaveDataset(paths string, file string) {
-	pathsArray := strings.Split(paths, ",")
+type (
+	// sampleReader reads the samples of a dataset one at a time
+	sampleReader interface {
+		// Read returns the next sample, and false once there are no more
+		Read() (Data, bool)
+		// Skipped returns the number of lines that were skipped so far, by
+		// the category of their error
+		Skipped() map[string]int
+		// Position returns the position of the last sample that is read, or
+		// nil when the input does not store positions
+		Position() *Position
+		Close()
+	}
 
-	f, err := os.Create(file)
-	if err != nil {
-		panic(err)
+	// textReader reads the samples of text (FEN) files, the lines are parsed
+	// in the background
+	textReader struct {
+		paths  []string
+		path   string
+		number int
+		file   io.ReadCloser
+		reader *bufio.Reader
+		chunks <-chan chan parsedChunk
+		chunk  []Data
+		// positions are the positions of the samples of the chunk
+		positions []Position
+		position  *Position
+		skipped   map[string]int
+		done      chan struct{}
+		// finished is closed once the parsing goroutine and its workers
+		// have stopped, and the file is closed
+		finished chan struct{}
+		// pending is the line that is read past the end of a block of the
+		// plain format
+		pending *textLine
+		// positionsOnly reads the positions of the samples without encoding
+		// them, the samples have no inputs
+		positionsOnly bool
 	}
-	defer f.Close()
 
-	buf8 := make([]byte, 8)
-	samples := countSamples(pathsArray)
-	binary.LittleEndian.PutUint64(buf8, uint64(samples))
-	_, err = f.Write(buf8)
-	if err != nil {
-		panic(err)
+	// textLine is a line of a text dataset, with its location for error
+	// messages
+	textLine struct {
+		text    string
+		path    string
+		number  int
+		tooLong bool
 	}
 
-	var buf4 = make([]byte, 4)
-	for _, path := range pathsArray {
-		file, err := os.Open(path)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
+	parsedChunk struct {
+		samples   []Data
+		positions []Position
+		skipped   map[string]int
+		// err is the first bad line of the chunk in strict mode, the lines
+		// after it are not parsed
+		err error
+	}
 
-		reader := bufio.NewReader(file)
-		skipNext := false
-		for true {
-			buf, pre, err := reader.ReadLine()
-			if errors.Is(err, io.EOF) {
-				break
-			} else if err != nil {
-				panic(err)
-			}
-			skipNext = pre
-			if pre {
-				continue
-			} else if skipNext {
-				skipNext = false
-				continue
-			}
-			line := string(buf)
-			if line == "" {
-				break
-			}
-			sample := ParseLine(line)
-			binary.LittleEndian.PutUint16(buf4, uint16(sample.Outcome))
-			_, err = f.Write(buf4)
-			if err != nil {
-				panic(err)
-			}
-			binary.LittleEndian.PutUint16(buf4, uint16(sample.Score))
-			_, err = f.Write(buf4)
+	// inputReader reads the samples of text and binpack files, each with the
+	// reader of its format
+	inputReader struct {
+		paths         []string
+		current       sampleReader
+		skipped       map[string]int
+		positionsOnly bool
+	}
+)
+
+var (
+	// ParsingThreads is the number of goroutines that parse the lines of
+	// text inputs
+	ParsingThreads = runtime.NumCPU()
+	// SinglePass loads text inputs without counting their samples first
+	SinglePass = false
+)
+
+const (
+	// parseChunkSize is the number of lines that are parsed together
+	parseChunkSize = 4096
+	// maxLineLength is the length of the longest line of text datasets
+	maxLineLength = 4096
+)
+
+// BinpackInputs reads all the inputs as binpacks, even the ones that are not
+// detected as binpacks
+var BinpackInputs = false
+
+// BinpackExtensions are the extensions of binpack files, binpack v2 files are
+// detected by their header regardless of their extension
+var BinpackExtensions = []string{".bin", ".binpack"}
+
+// ExpandPaths splits the comma separated paths, directories are replaced by
+// the files in them and glob patterns by the files that match them
+func ExpandPaths(paths string) []string {
+	expanded := make([]string, 0)
+	for _, path := range strings.Split(paths, ",") {
+		if strings.ContainsAny(path, "*?[") {
+			matches, err := filepath.Glob(path)
 			if err != nil {
 				panic(err)
 			}
-			binary.LittleEndian.PutUint16(buf4, uint16(len(sample.Input)))
-			_, err = f.Write(buf4)
-			if err != nil {
-				panic(err)
+			if len(matches) == 0 {
+				panic(fmt.Sprintf("No input matches %s", path))
 			}
-			for _, i := range sample.Input {
-				binary.LittleEndian.PutUint16(buf4, uint16(i))
-				_, err = f.Write(buf4)
-				if err != nil {
-					panic(err)
-				}
+			expanded = append(expanded, matches...)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			panic(err)
+		}
+		if !info.IsDir() {
+			expanded = append(expanded, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			panic(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				expanded = append(expanded, filepath.Join(path, entry.Name()))
 			}
 		}
 	}
+	return expanded
 }
 
-func LoadBinpack(path string) []Data {
-	f, err := os.Open(path)
+// gzipMagic is the header of gzip files
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzipFile closes both the decompressor and the file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
+
+// openInput opens a text or binpack input, gzip files are detected by their
+// header and decompressed on the fly
+func openInput(path string) io.ReadCloser {
+	file, err := os.Open(path)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
-
-	buf8 := make([]byte, 8)
-	_, err = io.ReadFull(f, buf8)
-	if err != nil {
+	magic := make([]byte, len(gzipMagic))
+	n, _ := io.ReadFull(file, magic)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		panic(err)
 	}
+	if n < len(magic) || !bytes.Equal(magic, gzipMagic) {
+		return file
+	}
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		panic(fmt.Sprintf("%s: %s", path, err))
+	}
+	return &gzipFile{Reader: reader, file: file}
+}
 
-	counter := int64(0)
+// isBinpack detects binpacks by their header or their extension, the .gz
+// extension of compressed binpacks is ignored
+func isBinpack(path string) bool {
+	if BinpackInputs {
+		return true
+	}
+	for _, extension := range BinpackExtensions {
+		if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), extension) {
+			return true
+		}
+	}
 
-	var buf4 = make([]byte, 4)
-	data := make([]Data, binary.LittleEndian.Uint64(buf8))
-	for i := 0; i < len(data); i++ {
-		_, err = io.ReadFull(f, buf4)
-		if err != nil {
-			panic(err)
+	file := openInput(path)
+	defer file.Close()
+	magic := make([]byte, len(BinpackMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return string(magic) == BinpackMagic
+}
+
+// openSamples returns a reader over all the samples of the files in order
+func openSamples(paths []string) sampleReader {
+	return &inputReader{paths: paths}
+}
+
+// openPositions is openSamples for the samples that are stored as positions,
+// the positions of the text and v3 binpack inputs are not encoded and their
+// samples have no inputs
+func openPositions(paths []string) sampleReader {
+	return &inputReader{paths: paths, positionsOnly: true}
+}
+
+func (r *inputReader) Read() (Data, bool) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return Data{}, false
+			}
+			path := r.paths[:1]
+			r.paths = r.paths[1:]
+			if isBinpack(path[0]) {
+				r.current = &binpackReader{paths: path, positionsOnly: r.positionsOnly}
+			} else {
+				r.current = &textReader{paths: path, positionsOnly: r.positionsOnly}
+			}
 		}
-		outcome := int8(binary.LittleEndian.Uint16(buf4))
-		_, err = io.ReadFull(f, buf4)
-		if err != nil {
-			panic(err)
+		if sample, ok := r.current.Read(); ok {
+			return sample, true
 		}
-		score := int16(binary.LittleEndian.Uint16(buf4))
-		_, err = io.ReadFull(f, buf4)
-		if err != nil {
-			panic(err)
+		r.Close()
+	}
+}
+
+func (r *inputReader) Position() *Position {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Position()
+}
+
+func (r *inputReader) Skipped() map[string]int {
+	skipped := make(map[string]int)
+	for category, count := range r.skipped {
+		skipped[category] += count
+	}
+	if r.current != nil {
+		for category, count := range r.current.Skipped() {
+			skipped[category] += count
 		}
-		inputLength := binary.LittleEndian.Uint16(buf4)
-		input := make([]int16, inputLength)
-		for j := uint16(0); j < inputLength; j++ {
-			_, err = io.ReadFull(f, buf4)
-			if err != nil {
-				panic(err)
-			}
-			input[j] = int16(binary.LittleEndian.Uint16(buf4))
+	}
+	return skipped
+}
+
+// Close closes the current file, and keeps its skipped lines
+func (r *inputReader) Close() {
+	if r.current == nil {
+		return
+	}
+	if r.skipped == nil {
+		r.skipped = make(map[string]int)
+	}
+	for category, count := range r.current.Skipped() {
+		r.skipped[category] += count
+	}
+	r.current.Close()
+	r.current = nil
+}
+
+func (r *textReader) Read() (Data, bool) {
+	if r.chunks == nil {
+		chunks := make(chan chan parsedChunk, 2*ParsingThreads)
+		r.chunks = chunks
+		r.skipped = make(map[string]int)
+		r.done = make(chan struct{})
+		r.finished = make(chan struct{})
+		go r.parse(chunks, r.done)
+	}
+	for len(r.chunk) == 0 {
+		next, ok := <-r.chunks
+		if !ok {
+			return Data{}, false
+		}
+		chunk := <-next
+		if chunk.err != nil {
+			panic(chunk.err)
+		}
+		r.chunk = chunk.samples
+		r.positions = chunk.positions
+		for category, count := range chunk.skipped {
+			r.skipped[category] += count
 		}
+	}
+	sample := r.chunk[0]
+	r.chunk = r.chunk[1:]
+	r.position = &r.positions[0]
+	r.positions = r.positions[1:]
+	return sample, true
+}
+
+func (r *textReader) Position() *Position {
+	return r.position
+}
 
-		data[i] = Data{
-			Score:   score,
-			Outcome: outcome,
-			Input:   input,
+// parse reads the lines in chunks, which are parsed on ParsingThreads
+// goroutines. The result channel of every chunk is sent in the order of the
+// lines, so that the samples are read in the same order regardless of which
+// goroutine parsed them
+func (r *textReader) parse(chunks chan<- chan parsedChunk, done <-chan struct{}) {
+	defer close(r.finished)
+	defer close(chunks)
+	defer r.closeFile()
+
+	type job struct {
+		lines  []textLine
+		result chan parsedChunk
+	}
+	jobs := make(chan job)
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	defer close(jobs)
+	for i := 0; i < ParsingThreads; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				job.result <- parseLines(job.lines, !r.positionsOnly)
+			}
+		}()
+	}
+
+	for {
+		lines := make([]textLine, 0, parseChunkSize)
+		for len(lines) < parseChunkSize {
+			line, ok := r.nextRecord()
+			if !ok {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			return
 		}
 
-		if counter == 2000 {
-			fmt.Printf("%d of %d is loaded\r", i, len(data))
-			counter = 0
+		result := make(chan parsedChunk, 1)
+		select {
+		case jobs <- job{lines: lines, result: result}:
+		case <-done:
+			return
+		}
+		select {
+		case chunks <- result:
+		case <-done:
+			return
 		}
-		counter++
 	}
-
-	return data
 }
 
-func LoadDataset(paths string) []Data {
-	pathsArray := strings.Split(paths, ",")
-	data := make([]Data, countSamples(pathsArray))
-	samples := 0
-	for _, path := range pathsArray {
-		file, err := os.Open(path)
-		if err != nil {
-			panic(err)
+// parseLines parses a chunk of lines, and encodes their positions unless
+// encode is false. In strict mode it stops at the first bad line and returns
+// its location as the error of the chunk. Blank lines are skipped, they are
+// not errors
+func parseLines(lines []textLine, encode bool) parsedChunk {
+	chunk := parsedChunk{
+		samples:   make([]Data, 0, len(lines)),
+		positions: make([]Position, 0, len(lines)),
+	}
+	for _, line := range lines {
+		var sample Data
+		var pos Position
+		var err error
+		if line.tooLong {
+			err = &ParseError{LongLine, fmt.Sprintf("the line is longer than %d bytes", maxLineLength)}
+		} else if strings.TrimSpace(line.text) == "" {
+			continue
+		} else if encode {
+			sample, pos, err = parseLine(line.text)
+		} else {
+			sample, pos, err = parseRecord(line.text)
 		}
-		defer file.Close()
 
-		reader := bufio.NewReader(file)
-		skipNext := false
-		for true {
-			buf, pre, err := reader.ReadLine()
-			if errors.Is(err, io.EOF) {
-				break
-			} else if err != nil {
-				panic(err)
+		if err == nil {
+			if keepSample(&sample, &pos) {
+				chunk.samples = append(chunk.samples, sample)
+				chunk.positions = append(chunk.positions, pos)
 			}
-			if pre {
-				continue
-			} else if skipNext {
-				skipNext = false
-				continue
+		} else if StrictParsing {
+			chunk.err = fmt.Errorf("%s:%d: %w", line.path, line.number, err)
+			return chunk
+		} else {
+			if chunk.skipped == nil {
+				chunk.skipped = make(map[string]int)
 			}
-			skipNext = pre
-			line := string(buf)
-			if line == "" {
-				break
+			chunk.skipped[err.(*ParseError).Category]++
+		}
+	}
+	return chunk
+}
+
+// nextRecord returns the next sample of the files, that is a line in all the
+// formats but the plain format, where it is a block of lines up to the e line
+// joined by line breaks
+func (r *textReader) nextRecord() (textLine, bool) {
+	if TextFormat != PlainFormat {
+		return r.nextLine()
+	}
+
+	record, ok := r.nextLine()
+	for ok && strings.TrimSpace(record.text) == "" && !record.tooLong {
+		record, ok = r.nextLine()
+	}
+	if !ok {
+		return record, false
+	}
+	lines := []string{record.text}
+	for strings.TrimSpace(lines[len(lines)-1]) != "e" {
+		line, ok := r.nextLine()
+		if !ok {
+			break
+		}
+		if line.path != record.path {
+			// The last block of the file is truncated
+			r.pending = &line
+			break
+		}
+		record.tooLong = record.tooLong || line.tooLong
+		lines = append(lines, line.text)
+	}
+	record.text = strings.Join(lines, "\n")
+	return record, true
+}
+
+// nextLine returns the next line of the files, and false after the last one
+func (r *textReader) nextLine() (textLine, bool) {
+	if r.pending != nil {
+		line := *r.pending
+		r.pending = nil
+		return line, true
+	}
+	for {
+		if r.reader == nil {
+			if len(r.paths) == 0 {
+				return textLine{}, false
 			}
-			sample := ParseLine(line)
-			data[samples] = sample
-			samples += 1
+			file := openInput(r.paths[0])
+			r.path = r.paths[0]
+			r.paths = r.paths[1:]
+			r.number = 0
+			r.file = file
+			r.reader = bufio.NewReaderSize(file, maxLineLength)
+		}
+
+		buf, pre, err := r.reader.ReadLine()
+		if errors.Is(err, io.EOF) {
+			r.closeFile()
+			continue
+		} else if err != nil {
+			panic(err)
+		}
+		r.number++
+		line := textLine{path: r.path, number: r.number}
+		if pre {
+			// The rest of the line is dropped
+			for pre && err == nil {
+				_, pre, err = r.reader.ReadLine()
+			}
+			line.tooLong = true
+			return line, true
+		}
+		line.text = string(buf)
+		return line, true
+	}
+}
+
+func (r *textReader) closeFile() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = nil
+	r.reader = nil
+}
+
+func (r *textReader) Skipped() map[string]int {
+	return r.skipped
+}
+
+// Close stops parsing, and waits until the parsing goroutine has closed the
+// files
+func (r *textReader) Close() {
+	if r.done != nil {
+		close(r.done)
+		<-r.finished
+		r.done = nil
+	}
+}
+
+// LoadDataset loads all the samples of the text and binpack inputs, weighed
+// by the weight rules
+func LoadDataset(paths string) []Data {
+	pathsArray := ExpandPaths(paths)
+	capacity := int64(0)
+	if !SinglePass && TextFormat != PlainFormat {
+		// Knowing the number of samples upfront avoids growing the dataset,
+		// the samples of the plain format span several lines so they are not
+		// counted
+		capacity = countSamples(pathsArray)
+	}
+	data := make([]Data, 0, capacity)
+	reader := openSamples(pathsArray)
+	defer reader.Close()
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
 		}
+		weighSample(&sample, reader.Position())
+		data = append(data, sample)
 	}
+	printSkipped(reader.Skipped())
+	printFiltered()
 
 	runtime.GC()
 
 	return data
 }
 
+// ParseLine parses a line of a text dataset in TextFormat, and panics when
+// the line is malformed
 func ParseLine(line string) Data {
-	startIndex := 0
+	data, err := TryParseLine(line)
+	if err != nil {
+		panic(fmt.Sprintf("Bad line %s\n%s\n", line, err))
+	}
+	return data
+}
+
+// TryParseLine is ParseLine that returns a ParseError instead of panicking
+func TryParseLine(line string) (Data, error) {
+	data, _, err := parseLine(line)
+	return data, err
+}
+
+// parseLine parses the line in TextFormat and encodes its position with
+// Features, and returns the position of the line too
+func parseLine(line string) (data Data, pos Position, err error) {
+	data, pos, err = parseRecord(line)
+	if err == nil {
+		data.Input, err = encodeSample(&pos)
+	}
+	return data, pos, err
+}
+
+// parseRecord parses the line in TextFormat without encoding its position,
+// the sample has no inputs
+func parseRecord(line string) (data Data, pos Position, err error) {
+	if strings.TrimSpace(line) == "" {
+		return data, pos, &ParseError{EmptyLine, "the line is empty"}
+	}
+	switch TextFormat {
+	case EPDFormat:
+		return parseEPD(line)
+	case PipeFormat:
+		return parsePipe(line)
+	case C9Format:
+		return parseC9(line)
+	case PlainFormat:
+		return parsePlain(line)
+	}
+	return parseFengen(line)
+}
+
+// parseFengen parses the FEN;score:..;eval:..;qs:..;outcome:.. lines of
+// fengen, the score and the outcome are relative to the side to move. The
+// lines can have an optional weight:.. field too
+func parseFengen(line string) (data Data, pos Position, err error) {
 	endIndex := strings.Index(line, ";")
 	if endIndex == -1 {
-		panic(fmt.Sprintf("Bad line %s\n", line))
+		return data, pos, &ParseError{MissingField, "expected the FEN followed by ; separated fields"}
 	}
 
-	pos := FromFen(line[:endIndex])
-	// wm := pos[len(pos)-1] == 768
+	pos, fenErr := TryParseFen(line[:endIndex])
+	if fenErr != nil {
+		return data, pos, &ParseError{BadFen, fenErr.Error()}
+	}
 
-	startIndex = endIndex + 7
-	endIndex = strings.Index(line, ";eval")
-	if endIndex == -1 {
-		panic(fmt.Sprintf("Bad line %s\n", line))
+	field := func(name string) (string, bool) {
+		startIndex := strings.Index(line, ";"+name+":")
+		if startIndex == -1 {
+			return "", false
+		}
+		value := line[startIndex+len(name)+2:]
+		if endIndex := strings.Index(value, ";"); endIndex != -1 {
+			value = value[:endIndex]
+		}
+		return value, true
 	}
 
-	score, err := strconv.Atoi(line[startIndex:endIndex])
+	value, ok := field("score")
+	if !ok {
+		return data, pos, &ParseError{MissingField, "no score"}
+	}
+	score, err := parseScore(value)
 	if err != nil {
-		panic(fmt.Sprintf("Bad line %s\n%s\n", line, err))
+		return data, pos, err
 	}
 
-	startIndex = strings.Index(line, ";outcome:") + 9
-	if startIndex == -1 {
-		panic(fmt.Sprintf("Bad line %s\n%s\n", line, err))
+	value, ok = field("outcome")
+	if !ok {
+		return data, pos, &ParseError{MissingField, "no outcome"}
 	}
 	var outcome int8
-	if line[startIndex:] == "0.0" {
+	switch value {
+	case "0.0", "0":
 		outcome = 0
-	} else if line[startIndex:] == "1.0" {
-		outcome = 2
-	} else {
+	case "0.5":
 		outcome = 1
+	case "1.0", "1":
+		outcome = 2
+	default:
+		return data, pos, &ParseError{BadOutcome, fmt.Sprintf("outcome %s is not one of 0.0, 0.5 and 1.0", value)}
+	}
+
+	data = newSample(score, outcome)
+	if value, ok := field("weight"); ok {
+		weight, weightErr := strconv.ParseFloat(value, 32)
+		if weightErr != nil || !(weight > 0) || math.IsInf(weight, 0) {
+			return data, pos, &ParseError{BadWeight, fmt.Sprintf("weight %s is not a positive number", value)}
+		}
+		data.setWeight(float32(weight))
+	}
+	return data, pos, nil
+}
+
+// lossWeight is the weight of the sample in the loss
+func (d *Data) lossWeight() float32 {
+	if !d.Weighted {
+		return 1
 	}
+	return d.Weight
+}
 
-	// if !wm {
-	// 	score *= -1
-	// 	if outcome == 2 {
-	// 		outcome = 0
-	// 	} else if outcome == 0 {
-	// 		outcome = 2
-	// 	}
-	// }
+func (d *Data) setWeight(weight float32) {
+	d.Weight = weight
+	d.Weighted = true
+}
 
+// parseScore parses a 16 bits score
+func parseScore(value string) (int16, error) {
+	score, err := strconv.Atoi(value)
+	if err != nil || score < math.MinInt16 || score > math.MaxInt16 {
+		return 0, &ParseError{BadScore, fmt.Sprintf("score %s is not a 16 bits integer", value)}
+	}
+	return int16(score), nil
+}
+
+// newSample returns a sample without inputs, the score and the outcome are
+// relative to the side to move
+func newSample(score int16, outcome int8) Data {
 	return Data{
-		Input:   pos,
-		Score:   int16(score),
+		Score:   score,
 		Outcome: outcome,
 	}
 }
+
+// encodeSample encodes the position of a sample with Features
+func encodeSample(pos *Position) ([]int16, error) {
+	input, err := encode(pos)
+	if err != nil {
+		return nil, &ParseError{BadPosition, err.Error()}
+	}
+	return input, nil
+}
+
+// encode encodes the position with Features, feature sets panic on positions
+// they can not encode, i.e. king bucketed feature sets on positions without
+// kings
+func encode(pos *Position) (input []int16, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return Features.Encode(pos), nil
+}
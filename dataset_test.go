@@ -1,6 +1,11 @@
 package main
 
 import (
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -37,3 +42,168 @@ func sameArray16(expected, actual []int16) bool {
 	}
 	return true
 }
+
+func TestMixedInputs(t *testing.T) {
+	dir := t.TempDir()
+	text := writeDataset(t, 30)
+	if err := os.Rename(text, filepath.Join(dir, "a.epd")); err != nil {
+		t.Fatal(err)
+	}
+	// A binpack v2 is detected by its header, whatever its extension is
+	SaveDataset(filepath.Join(dir, "a.epd"), filepath.Join(dir, "b.shard"))
+
+	if !isBinpack(filepath.Join(dir, "b.shard")) || isBinpack(filepath.Join(dir, "a.epd")) {
+		t.Errorf("Binpacks are detected wrong")
+	}
+
+	paths := ExpandPaths(dir + "," + filepath.Join(dir, "*.epd"))
+	expected := []string{filepath.Join(dir, "a.epd"), filepath.Join(dir, "b.shard"), filepath.Join(dir, "a.epd")}
+	if len(paths) != len(expected) {
+		t.Fatalf("Got %v, Expected %v", paths, expected)
+	}
+	for i := range paths {
+		if paths[i] != expected[i] {
+			t.Errorf("Got %v, Expected %v", paths, expected)
+		}
+	}
+
+	data := LoadDataset(dir)
+	if len(data) != 60 || data[29].Score != 29 || data[30].Score != 0 {
+		t.Errorf("Expected the text samples followed by the binpack samples, got %d samples", len(data))
+	}
+}
+
+// compressFile compresses the file into dir, with the .gz extension
+func compressFile(t *testing.T, path, dir string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, filepath.Base(path)+".gz")
+	f, err := os.Create(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := gzip.NewWriter(f)
+	if _, err := writer.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	f.Close()
+	return compressed
+}
+
+func TestGzipInputs(t *testing.T) {
+	dir := t.TempDir()
+	text := compressFile(t, writeDataset(t, 30), dir)
+	binpack := filepath.Join(t.TempDir(), "b.bin")
+	SaveDataset(text, binpack)
+	binpack = compressFile(t, binpack, dir)
+
+	if isBinpack(text) || !isBinpack(binpack) {
+		t.Errorf("Compressed binpacks are detected wrong")
+	}
+	if count := countSamples([]string{text, binpack}); count != 60 {
+		t.Errorf("Expected 60 samples to be counted, got %d", count)
+	}
+	data := LoadDataset(text + "," + binpack)
+	if len(data) != 60 || data[29].Score != 29 || data[59].Score != 29 {
+		t.Errorf("Expected the text samples followed by the binpack samples, got %d samples", len(data))
+	}
+}
+
+func TestParallelParsing(t *testing.T) {
+	defer func(threads int, singlePass bool) {
+		ParsingThreads, SinglePass = threads, singlePass
+	}(ParsingThreads, SinglePass)
+
+	path := writeDataset(t, 3*parseChunkSize+17)
+	for _, threads := range []int{1, 4} {
+		for _, singlePass := range []bool{false, true} {
+			ParsingThreads, SinglePass = threads, singlePass
+			data := LoadDataset(path)
+			if len(data) != 3*parseChunkSize+17 {
+				t.Fatalf("Expected %d samples, got %d", 3*parseChunkSize+17, len(data))
+			}
+			for i, sample := range data {
+				if int(sample.Score) != i {
+					t.Fatalf("Sample %d is out of order, got the sample of line %d", i, sample.Score)
+				}
+			}
+		}
+	}
+}
+
+func TestLenientParsing(t *testing.T) {
+	defer func(strict bool) { StrictParsing = strict }(StrictParsing)
+
+	path := filepath.Join(t.TempDir(), "bad.epd")
+	lines := []string{
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5",
+		"",
+		"4k3/8/8/8/8/8/4X3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:ten;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:40000;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:2.0",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1",
+		string(make([]byte, maxLineLength+10)),
+		"4k3/8/8/8/8/8/4P3/4K3 b - - 0 1;score:20;eval:0;qs:0;outcome:1.0",
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		f.WriteString(line + "\n")
+	}
+	f.Close()
+
+	StrictParsing = false
+	reader := openSamples([]string{path})
+	data := make([]Data, 0)
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		data = append(data, sample)
+	}
+	reader.Close()
+	if len(data) != 2 || data[0].Score != 10 || data[1].Score != 20 {
+		t.Errorf("Expected the first and last samples, got %v", data)
+	}
+	expected := map[string]int{BadFen: 1, BadScore: 2, BadOutcome: 1, MissingField: 2, LongLine: 1}
+	skipped := reader.Skipped()
+	for category, count := range expected {
+		if skipped[category] != count {
+			t.Errorf("Expected %d lines of %s, got %d", count, category, skipped[category])
+		}
+	}
+
+	// Blank lines are skipped in strict mode too, the first bad line is
+	// reported to the reader
+	StrictParsing = true
+	chunk := parseLines([]textLine{{text: lines[0], path: path, number: 1}, {text: lines[1], path: path, number: 2}}, true)
+	if chunk.err != nil || len(chunk.samples) != 1 {
+		t.Errorf("Expected the blank line to be skipped, got %v", chunk.err)
+	}
+	reader = openSamples([]string{path})
+	defer reader.Close()
+	defer func() {
+		expected := path + ":3: " + BadFen
+		r := recover()
+		if err, ok := r.(error); !ok || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Expected a panic starting with %s, got %v", expected, r)
+		}
+		var parseErr *ParseError
+		if err, ok := r.(error); ok && (!errors.As(err, &parseErr) || parseErr.Category != BadFen) {
+			t.Errorf("Expected a parse error, got %v", err)
+		}
+	}()
+	for {
+		if _, ok := reader.Read(); !ok {
+			break
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// DuplicatePolicy decides what is kept of the samples of a repeated position
+type DuplicatePolicy uint32
+
+const (
+	// KeepDuplicates does not deduplicate the samples
+	KeepDuplicates DuplicatePolicy = iota
+	// KeepFirst keeps the first sample of every position
+	KeepFirst
+	// AverageScores keeps the first sample of every position, with the mean
+	// score of all of its samples
+	AverageScores
+	// AverageOutcomes keeps the first sample of every position, with the mean
+	// outcome of all of its samples
+	AverageOutcomes
+)
+
+var duplicatePolicyNames = []string{"none", "first", "average-scores", "average-outcomes"}
+
+// Deduplication is the policy that is applied when datasets are stored
+var Deduplication = KeepDuplicates
+
+func (p DuplicatePolicy) String() string {
+	return duplicatePolicyNames[p]
+}
+
+func ParseDuplicatePolicy(name string) DuplicatePolicy {
+	return DuplicatePolicy(indexOf(duplicatePolicyNames, name))
+}
+
+// deduplicator collects the unique positions of a dataset. Positions are
+// keyed by their board and side to move, castling rights, en passant squares
+// and clocks are not part of the key. Samples of binpacks of features have no
+// position, they are keyed by their sorted inputs instead, which only tells
+// apart the positions that the feature set tells apart
+type deduplicator struct {
+	policy     DuplicatePolicy
+	index      map[string]int
+	samples    []Data
+	positions  []*Position
+	scores     []int64
+	outcomes   []int64
+	counts     []int64
+	duplicates int
+	key        []byte
+	features   []int
+}
+
+func newDeduplicator(policy DuplicatePolicy) *deduplicator {
+	return &deduplicator{
+		policy: policy,
+		index:  make(map[string]int),
+	}
+}
+
+// Add returns whether the sample is the first one of its position. Unless
+// the policy is KeepFirst, the first samples are collected with their
+// positions, which can be nil, so that their scores or outcomes can be
+// averaged
+func (d *deduplicator) Add(sample Data, pos *Position) bool {
+	d.setKey(sample, pos)
+	if i, ok := d.index[string(d.key)]; ok {
+		d.duplicates++
+		if d.policy != KeepFirst {
+			d.scores[i] += int64(sample.Score)
+			d.outcomes[i] += int64(sample.Outcome)
+			d.counts[i]++
+		}
+		return false
+	}
+
+	if d.policy == KeepFirst {
+		d.index[string(d.key)] = -1
+		return true
+	}
+	d.index[string(d.key)] = len(d.samples)
+	d.samples = append(d.samples, sample)
+	d.positions = append(d.positions, pos)
+	d.scores = append(d.scores, int64(sample.Score))
+	d.outcomes = append(d.outcomes, int64(sample.Outcome))
+	d.counts = append(d.counts, 1)
+	return true
+}
+
+func (d *deduplicator) setKey(sample Data, pos *Position) {
+	d.key = d.key[:0]
+	if pos != nil {
+		for _, piece := range pos.Board {
+			d.key = append(d.key, byte(piece))
+		}
+		d.key = append(d.key, byte(pos.SideToMove))
+		return
+	}
+	d.features = d.features[:0]
+	for _, feature := range sample.Input {
+		d.features = append(d.features, int(feature))
+	}
+	sort.Ints(d.features)
+	for _, feature := range d.features {
+		d.key = append(d.key, 0, 0)
+		binary.LittleEndian.PutUint16(d.key[len(d.key)-2:], uint16(feature))
+	}
+}
+
+// Samples returns the collected samples with their averages applied and their
+// positions, in the order of their first appearance
+func (d *deduplicator) Samples() ([]Data, []*Position) {
+	for i := range d.samples {
+		switch d.policy {
+		case AverageScores:
+			d.samples[i].Score = int16(roundedMean(d.scores[i], d.counts[i]))
+		case AverageOutcomes:
+			d.samples[i].Outcome = int8(roundedMean(d.outcomes[i], d.counts[i]))
+		}
+	}
+	return d.samples, d.positions
+}
+
+func (d *deduplicator) printDuplicates() {
+	fmt.Printf("Removed %d duplicate positions (%s)\n", d.duplicates, d.policy)
+}
+
+// roundedMean rounds half away from zero
+func roundedMean(sum, count int64) int64 {
+	if sum < 0 {
+		return -((-sum + count/2) / count)
+	}
+	return (sum + count/2) / count
+}
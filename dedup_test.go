@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeduplicate(t *testing.T) {
+	start := ParseFen("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
+	other := ParseFen("rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1")
+	later := ParseFen("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w - - 4 3")
+	dataset := func() ([]Data, []*Position) {
+		return []Data{
+			{Score: 10, Outcome: 2},
+			{Score: -5, Outcome: 1},
+			{Score: 21, Outcome: 1},
+			{Score: 30, Outcome: 1},
+		}, []*Position{
+			&start, &other, &start, &later,
+		}
+	}
+
+	expected := map[DuplicatePolicy][]Data{
+		KeepFirst:       {{Score: 10, Outcome: 2}, {Score: -5, Outcome: 1}},
+		AverageScores:   {{Score: 20, Outcome: 2}, {Score: -5, Outcome: 1}},
+		AverageOutcomes: {{Score: 10, Outcome: 1}, {Score: -5, Outcome: 1}},
+	}
+	for policy, want := range expected {
+		d := newDeduplicator(policy)
+		data, positions := dataset()
+		var got []Data
+		for i, sample := range data {
+			if d.Add(sample, positions[i]) && policy == KeepFirst {
+				got = append(got, sample)
+			}
+		}
+		if policy != KeepFirst {
+			got, _ = d.Samples()
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: expected %d samples, got %d", policy, len(want), len(got))
+			continue
+		}
+		for i := range got {
+			if got[i].Score != want[i].Score || got[i].Outcome != want[i].Outcome {
+				t.Errorf("%s: expected %v, got %v", policy, want[i], got[i])
+			}
+		}
+	}
+}
+
+func TestDeduplicateFeatures(t *testing.T) {
+	// Samples without a position are keyed by their inputs, in any order
+	d := newDeduplicator(KeepFirst)
+	if !d.Add(Data{Input: []int16{3, 1, 2}}, nil) {
+		t.Errorf("Expected the first sample to be kept")
+	}
+	if d.Add(Data{Input: []int16{1, 2, 3}}, nil) {
+		t.Errorf("Expected the reordered inputs to be a duplicate")
+	}
+	if !d.Add(Data{Input: []int16{1, 2, 4}}, nil) {
+		t.Errorf("Expected other inputs to be kept")
+	}
+}
+
+func TestDeduplicateHalfKP(t *testing.T) {
+	defer func(features FeatureSet) { Features = features }(Features)
+	defer func(policy DuplicatePolicy) { Deduplication = policy }(Deduplication)
+	Features = NewKingBucketed(NewKingBuckets(4, true), false)
+
+	// The kings on a1 and b1 share a bucket, the positions have the same
+	// features but they are not duplicates
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.epd")
+	lines := "4k3/8/8/8/8/8/4P3/K7 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5\n" +
+		"4k3/8/8/8/8/8/4P3/1K6 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5\n"
+	if err := os.WriteFile(input, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a1 := ParseFen("4k3/8/8/8/8/8/4P3/K7 w - - 0 1")
+	b1 := ParseFen("4k3/8/8/8/8/8/4P3/1K6 w - - 0 1")
+	if !sameFeatures(Features.Encode(&a1), Features.Encode(&b1)) {
+		t.Fatalf("Expected the positions to have the same features")
+	}
+
+	output := filepath.Join(dir, "output.bin")
+	Deduplication = KeepFirst
+	SaveDataset(input, output)
+	if data := loadBinpack(output); len(data) != 2 {
+		t.Errorf("Expected both positions to be kept, got %v", data)
+	}
+}
+
+func TestSaveDeduplicatedDataset(t *testing.T) {
+	defer func(policy DuplicatePolicy) { Deduplication = policy }(Deduplication)
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.epd")
+	lines := "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5\n" +
+		"4k3/8/8/8/8/8/4P3/4K3 b - - 0 1;score:10;eval:0;qs:0;outcome:0.5\n" +
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 3 7;score:-20;eval:0;qs:0;outcome:0.0\n"
+	if err := os.WriteFile(input, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output.bin")
+
+	Deduplication = AverageScores
+	SaveDataset(input, output)
+	data := loadBinpack(output)
+	if len(data) != 2 || data[0].Score != -5 || data[1].Score != 10 {
+		t.Errorf("Expected the averaged white sample and the black sample, got %v", data)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type (
+	// FeatureSet decides how a position is fed to the network
+	FeatureSet interface {
+		// Name of the feature set, as used on the command line
+		Name() string
+		// Size is the number of inputs of a single perspective
+		Size() uint32
+		// Perspective feature sets encode the position once for each side,
+		// side to move first, both halves are of the same length
+		Perspective() bool
+		// Encode returns the indices of the active features of the position
+		Encode(pos *Position) []int16
+		// Pieces returns the number of pieces, kings included, of an encoded
+		// position
+		Pieces(input []int16) int
+	}
+
+	// PieceSquare is the default feature set, with a feature for each piece
+	// on each square and one for the side to move
+	PieceSquare struct{}
+
+	// PerspectivePieceSquare is the piece square feature set seen from both
+	// sides of the board
+	PerspectivePieceSquare struct{}
+
+	// KingBucketed is the HalfKP and HalfKA feature sets
+	KingBucketed struct {
+		Buckets   KingBuckets
+		WithKings bool
+	}
+
+	// Factorizer is implemented by the feature sets that can be trained with
+	// virtual features, each real feature has exactly one virtual feature
+	// that is shared with other real features
+	Factorizer interface {
+		FeatureSet
+		// VirtualSize is the number of virtual features of a perspective
+		VirtualSize() uint32
+		// Virtual returns the virtual feature of the given real feature
+		Virtual(feature int16) int16
+	}
+
+	// Factorized trains a feature set alongside its virtual features, the
+	// virtual features follow the real features of each perspective and are
+	// numbered after them
+	Factorized struct {
+		Base Factorizer
+	}
+
+	// Decoder is implemented by the feature sets that can recover the
+	// position of an encoded input. The position is only known up to the
+	// symmetries that the feature set ignores, but encoding it again results
+	// in the same input
+	Decoder interface {
+		FeatureSet
+		Decode(input []int16) Position
+	}
+
+	// FeatureKind identifies the encoding of the inputs of a network
+	FeatureKind uint32
+
+	// KingBuckets maps the square of the king of a perspective to the bucket
+	// of the first layer weights that are used for that king square
+	KingBuckets struct {
+		Count   uint32
+		Mirror  bool
+		buckets [64]uint32
+	}
+)
+
+const (
+	// PieceSquareFeatures is the plain piece*64 + square encoding
+	PieceSquareFeatures FeatureKind = iota
+	// HalfKPFeatures encodes every non-king piece relative to the king of
+	// the perspective
+	HalfKPFeatures
+	// HalfKAFeatures is like HalfKP, but the kings are encoded too
+	HalfKAFeatures
+)
+
+const (
+	NumberOfHalfKPInputs = 640
+	NumberOfHalfKAInputs = 768
+)
+
+var featureKindNames = []string{"piece-square", "halfkp", "halfka"}
+
+func (k FeatureKind) String() string {
+	if int(k) < len(featureKindNames) {
+		return featureKindNames[k]
+	}
+	return fmt.Sprintf("unknown(%d)", k)
+}
+
+// ParseFeatureKind returns the feature kind that has the given name
+func ParseFeatureKind(name string) FeatureKind {
+	for i, n := range featureKindNames {
+		if strings.EqualFold(n, name) {
+			return FeatureKind(i)
+		}
+	}
+	panic(fmt.Sprintf("Unknown feature set %s, expected one of %s", name, featureKindNames))
+}
+
+// NewKingBuckets splits the board into count buckets, the ranks are split
+// first and then the files. When mirrored, kings on the e-h files use the
+// buckets of the mirrored square, and the pieces are mirrored with them, so
+// only the a-d files are split.
+func NewKingBuckets(count uint32, mirror bool) KingBuckets {
+	files := uint32(8)
+	if mirror {
+		files = 4
+	}
+	if count == 0 || count&(count-1) != 0 || count > files*8 {
+		panic(fmt.Sprintf("Number of king buckets must be a power of two between 1 and %d, got %d", files*8, count))
+	}
+
+	rankGroups := count
+	if rankGroups > 8 {
+		rankGroups = 8
+	}
+	fileGroups := count / rankGroups
+
+	kb := KingBuckets{Count: count, Mirror: mirror}
+	for sq := uint32(0); sq < 64; sq++ {
+		rank, file := sq/8, sq%8
+		if mirror && file >= 4 {
+			file = 7 - file
+		}
+		kb.buckets[sq] = (rank*rankGroups/8)*fileGroups + file*fileGroups/files
+	}
+	return kb
+}
+
+// Bucket returns the bucket of the king square, and whether the pieces need
+// to be mirrored horizontally
+func (kb *KingBuckets) Bucket(king Square) (uint32, bool) {
+	return kb.buckets[king], kb.Mirror && king%8 >= 4
+}
+
+// Inputs returns the number of inputs of a single perspective of the given
+// king bucketed feature kind
+func (kb *KingBuckets) Inputs(kind FeatureKind) uint32 {
+	if kind == HalfKAFeatures {
+		return kb.Count * NumberOfHalfKAInputs
+	}
+	return kb.Count * NumberOfHalfKPInputs
+}
+
+// checkInputRange makes sure that all the feature indices fit in an int16
+func checkInputRange(inputs uint32) {
+	if inputs > math.MaxInt16+1 {
+		panic(fmt.Sprintf("Feature set has %d inputs, at most %d are supported", inputs, math.MaxInt16+1))
+	}
+}
+
+// realFeatureSet returns the feature set of the topology, without virtual
+// features
+func (t *Topology) realFeatureSet() FeatureSet {
+	switch t.Features {
+	case HalfKPFeatures:
+		return NewKingBucketed(NewKingBuckets(t.KingBuckets, t.MirrorKings), false)
+	case HalfKAFeatures:
+		return NewKingBucketed(NewKingBuckets(t.KingBuckets, t.MirrorKings), true)
+	}
+	if t.Perspective {
+		return PerspectivePieceSquare{}
+	}
+	return PieceSquare{}
+}
+
+// FeatureSet returns the feature set that produces the inputs of the topology,
+// including the virtual features of factorized topologies
+func (t *Topology) FeatureSet() FeatureSet {
+	features := t.realFeatureSet()
+	if !t.Factorized {
+		return features
+	}
+	factorizer, ok := features.(Factorizer)
+	if !ok {
+		panic(fmt.Sprintf("Feature set %s can not be factorized", features.Name()))
+	}
+	return NewFactorized(factorizer)
+}
+
+// Implementing PieceSquare
+
+func (PieceSquare) Name() string {
+	return PieceSquareFeatures.String()
+}
+
+func (PieceSquare) Size() uint32 {
+	return 769
+}
+
+func (PieceSquare) Perspective() bool {
+	return false
+}
+
+// Encode walks the board in FEN order, and when white is to move the side to
+// move feature (768) is appended
+func (PieceSquare) Encode(pos *Position) []int16 {
+	input := make([]int16, 0, 33)
+	for _, rank := range ranks {
+		for sq := rank; sq < rank+8; sq++ {
+			if p := pos.Board[sq]; p != NoPiece {
+				input = append(input, int16(p)*64+int16(sq))
+			}
+		}
+	}
+	if pos.SideToMove == White {
+		input = append(input, 768)
+	}
+	return input
+}
+
+func (PieceSquare) Pieces(input []int16) int {
+	if len(input) > 0 && input[len(input)-1] == 768 {
+		return len(input) - 1
+	}
+	return len(input)
+}
+
+// Decode is the inverse of Encode, the castling rights can not be encoded so
+// all the rights that the board allows are assumed
+func (PieceSquare) Decode(input []int16) Position {
+	pos := emptyPosition()
+	pos.SideToMove = Black
+	for _, f := range input {
+		if f == 768 {
+			pos.SideToMove = White
+		} else {
+			pos.Board[f%64] = Piece(f / 64)
+		}
+	}
+	pos.Castling = pos.possibleCastling()
+	return pos
+}
+
+// Implementing PerspectivePieceSquare
+
+func (PerspectivePieceSquare) Name() string {
+	return "perspective-" + PieceSquareFeatures.String()
+}
+
+func (PerspectivePieceSquare) Size() uint32 {
+	return 768
+}
+
+func (PerspectivePieceSquare) Perspective() bool {
+	return true
+}
+
+// Encode encodes the position from the perspective of both sides, the
+// features of the side to move come first followed by the features of the
+// other side. Each perspective sees its own pieces as white pieces, and the
+// board from its own side, that is the board is flipped for black.
+func (PerspectivePieceSquare) Encode(pos *Position) []int16 {
+	pieces := pos.PieceCount()
+	input := make([]int16, 2*pieces)
+	stm := 0
+	nstm := pieces
+	for sq, p := range pos.Board {
+		if p == NoPiece {
+			continue
+		}
+		white := int16(p)*64 + int16(sq)
+		black := int16(p.Flip())*64 + int16(Square(sq).Flip())
+		if pos.SideToMove == White {
+			input[stm], input[nstm] = white, black
+		} else {
+			input[stm], input[nstm] = black, white
+		}
+		stm++
+		nstm++
+	}
+
+	return input
+}
+
+func (PerspectivePieceSquare) Pieces(input []int16) int {
+	return len(input) / 2
+}
+
+// Decode returns the board as seen by the side to move, with white to move
+func (PerspectivePieceSquare) Decode(input []int16) Position {
+	pos := emptyPosition()
+	for _, f := range input[:len(input)/2] {
+		pos.Board[f%64] = Piece(f / 64)
+	}
+	pos.Castling = pos.possibleCastling()
+	return pos
+}
+
+// Implementing KingBucketed
+
+// NewKingBucketed returns the HalfKA feature set if withKings is set, and
+// HalfKP otherwise
+func NewKingBucketed(kb KingBuckets, withKings bool) *KingBucketed {
+	set := &KingBucketed{Buckets: kb, WithKings: withKings}
+	checkInputRange(set.Size())
+	return set
+}
+
+func (k *KingBucketed) kind() FeatureKind {
+	if k.WithKings {
+		return HalfKAFeatures
+	}
+	return HalfKPFeatures
+}
+
+func (k *KingBucketed) Name() string {
+	return k.kind().String()
+}
+
+func (k *KingBucketed) Size() uint32 {
+	return k.Buckets.Inputs(k.kind())
+}
+
+func (k *KingBucketed) Perspective() bool {
+	return true
+}
+
+// Encode produces the features of both perspectives, side to move first
+func (k *KingBucketed) Encode(pos *Position) []int16 {
+	pieces := pos.PieceCount()
+	if !k.WithKings {
+		pieces -= 2
+	}
+
+	input := make([]int16, 0, 2*pieces)
+	input = k.appendPerspective(input, pos, pos.SideToMove)
+	input = k.appendPerspective(input, pos, 1-pos.SideToMove)
+	return input
+}
+
+func (k *KingBucketed) Pieces(input []int16) int {
+	if k.WithKings {
+		return len(input) / 2
+	}
+	return len(input)/2 + 2
+}
+
+// appendPerspective appends the features of the board as seen by the given
+// perspective
+func (k *KingBucketed) appendPerspective(input []int16, pos *Position, perspective Color) []int16 {
+	orient := func(sq Square) Square {
+		if perspective == Black {
+			return sq.Flip()
+		}
+		return sq
+	}
+
+	king := pos.King(perspective)
+	if king == NoSquare {
+		panic("Position without a king can not be encoded with king buckets")
+	}
+
+	bucket, mirror := k.Buckets.Bucket(orient(king))
+	inputs := NumberOfHalfKPInputs
+	if k.WithKings {
+		inputs = NumberOfHalfKAInputs
+	}
+	for sq, p := range pos.Board {
+		if p == NoPiece {
+			continue
+		}
+		if perspective == Black {
+			p = p.Flip()
+		}
+		index := int(p)
+		if !k.WithKings {
+			if p == WhiteKing || p == BlackKing {
+				continue
+			} else if p > WhiteKing {
+				index--
+			}
+		}
+		square := orient(Square(sq))
+		if mirror {
+			square ^= 7
+		}
+		input = append(input, int16(int(bucket)*inputs+index*64+int(square)))
+	}
+	return input
+}
+
+// Decode returns the board as seen by the side to move, with white to move.
+// HalfKP does not encode the kings, so only HalfKA inputs can be decoded
+func (k *KingBucketed) Decode(input []int16) Position {
+	if !k.WithKings {
+		panic(fmt.Sprintf("Feature set %s can not be decoded", k.Name()))
+	}
+	pos := emptyPosition()
+	for _, f := range input[:len(input)/2] {
+		f %= NumberOfHalfKAInputs
+		pos.Board[f%64] = Piece(f / 64)
+	}
+	pos.Castling = pos.possibleCastling()
+	return pos
+}
+
+// VirtualSize is the number of piece square features
+func (k *KingBucketed) VirtualSize() uint32 {
+	if k.WithKings {
+		return NumberOfHalfKAInputs
+	}
+	return NumberOfHalfKPInputs
+}
+
+// Virtual returns the piece square feature of the real feature, that is the
+// real feature regardless of the king bucket
+func (k *KingBucketed) Virtual(feature int16) int16 {
+	return feature % int16(k.VirtualSize())
+}
+
+// Implementing Factorized
+
+func NewFactorized(base Factorizer) *Factorized {
+	set := &Factorized{Base: base}
+	checkInputRange(set.Size())
+	return set
+}
+
+func (f *Factorized) Name() string {
+	return f.Base.Name() + "-factorized"
+}
+
+func (f *Factorized) Size() uint32 {
+	return f.Base.Size() + f.Base.VirtualSize()
+}
+
+func (f *Factorized) Perspective() bool {
+	return f.Base.Perspective()
+}
+
+// Encode appends the virtual features to the real features of each
+// perspective
+func (f *Factorized) Encode(pos *Position) []int16 {
+	real := f.Base.Encode(pos)
+	input := make([]int16, 0, 2*len(real))
+	if f.Base.Perspective() {
+		half := len(real) / 2
+		input = f.appendWithVirtuals(input, real[:half])
+		input = f.appendWithVirtuals(input, real[half:])
+	} else {
+		input = f.appendWithVirtuals(input, real)
+	}
+	return input
+}
+
+// Pieces ignores the virtual features, every real feature has exactly one
+func (f *Factorized) Pieces(input []int16) int {
+	return f.Base.Pieces(input[:len(input)/2])
+}
+
+// Decode ignores the virtual features, the base feature set has to be a
+// Decoder
+func (f *Factorized) Decode(input []int16) Position {
+	decoder, ok := f.Base.(Decoder)
+	if !ok {
+		panic(fmt.Sprintf("Feature set %s can not be decoded", f.Name()))
+	}
+	// Each perspective has as many virtual features as real features, so the
+	// real features of the first perspective are in the first half
+	return decoder.Decode(input[:len(input)/2])
+}
+
+func (f *Factorized) appendWithVirtuals(input []int16, real []int16) []int16 {
+	input = append(input, real...)
+	offset := int16(f.Base.Size())
+	for _, feature := range real {
+		input = append(input, offset+f.Base.Virtual(feature))
+	}
+	return input
+}
+
+// Fold merges the weights of the virtual features into the weights of the
+// real features, weights is the first layer and has a column for every real
+// and virtual feature, the result only has the columns of the real features
+func (f *Factorized) Fold(weights Matrix) Matrix {
+	size := f.Base.Size()
+	rows := weights.Rows
+	data := make([]float32, rows*size)
+	for feature := uint32(0); feature < size; feature++ {
+		virtual := size + uint32(f.Base.Virtual(int16(feature)))
+		real := weights.Data[feature*rows : (feature+1)*rows]
+		shared := weights.Data[virtual*rows : (virtual+1)*rows]
+		for j := uint32(0); j < rows; j++ {
+			data[feature*rows+j] = real[j] + shared[j]
+		}
+	}
+	return NewMatrix(rows, size, data)
+}
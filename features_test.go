@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestKingBuckets(t *testing.T) {
+	kb := NewKingBuckets(32, true)
+	for sq := A1; sq <= H8; sq++ {
+		bucket, mirror := kb.Bucket(sq)
+		mirrored, _ := kb.Bucket(sq ^ 7)
+		if bucket != mirrored {
+			t.Errorf("Square %d and its mirror are in different buckets, %d and %d", sq, bucket, mirrored)
+		}
+		if mirror != (sq%8 >= 4) {
+			t.Errorf("Square %d is mirrored wrong", sq)
+		}
+	}
+
+	kb = NewKingBuckets(4, false)
+	expected := map[Square]uint32{A1: 0, H2: 0, A3: 1, H4: 1, D5: 2, E6: 2, A7: 3, H8: 3}
+	for sq, bucket := range expected {
+		if actual, _ := kb.Bucket(sq); actual != bucket {
+			t.Errorf("Square %d is in the wrong bucket, expected %d, got %d", sq, bucket, actual)
+		}
+	}
+}
+
+func TestPerspectivePieceSquare(t *testing.T) {
+	whitePos := ParseFen("4k3/8/8/8/8/8/4P3/4K3 w - - 0 1")
+	blackPos := ParseFen("4k3/4p3/8/8/8/8/8/4K3 b - - 0 1")
+	white := PerspectivePieceSquare{}.Encode(&whitePos)
+	black := PerspectivePieceSquare{}.Encode(&blackPos)
+
+	expected := []int16{324, 12, 764, 764, 436, 324}
+	if !sameArray16(white, expected) {
+		t.Errorf("Position is parsed wrong, expected %v, got %v", expected, white)
+	}
+
+	// The second position is the color flipped twin of the first one, so
+	// both of them look the same from either perspective
+	sort.Slice(white[:3], func(i, j int) bool { return white[i] < white[j] })
+	sort.Slice(white[3:], func(i, j int) bool { return white[3+i] < white[3+j] })
+	sort.Slice(black[:3], func(i, j int) bool { return black[i] < black[j] })
+	sort.Slice(black[3:], func(i, j int) bool { return black[3+i] < black[3+j] })
+	if !sameArray16(white, black) {
+		t.Errorf("Perspectives do not match, expected %v, got %v", white, black)
+	}
+}
+
+func TestHalfKP(t *testing.T) {
+	features := NewKingBucketed(NewKingBuckets(1, false), false)
+
+	pos := ParseFen("4k3/8/8/8/8/8/4P3/4K3 w - - 0 1")
+	input := features.Encode(&pos)
+
+	// Only the white pawn is encoded, once for each perspective
+	expected := []int16{12, 5*64 + 52}
+	if !sameArray16(input, expected) {
+		t.Errorf("Position is encoded wrong, expected %v, got %v", expected, input)
+	}
+}
+
+func TestHalfKAMirrored(t *testing.T) {
+	features := NewKingBucketed(NewKingBuckets(32, true), true)
+
+	pos := ParseFen("8/8/8/8/8/8/3kP3/7K b - - 0 1")
+	input := features.Encode(&pos)
+
+	// The black king on D2 is seen as a white king on D7 from black's
+	// perspective, while the white king on H1 is mirrored to A1 from white's
+	kb := NewKingBuckets(32, true)
+	bucket, _ := kb.Bucket(D7)
+	base := int16(bucket) * NumberOfHalfKAInputs
+	expected := []int16{
+		base + int16(BlackKing)*64 + int16(H8),
+		base + int16(WhiteKing)*64 + int16(D7),
+		base + int16(BlackPawn)*64 + int16(E7),
+		int16(WhiteKing)*64 + int16(A1),
+		int16(BlackKing)*64 + int16(E2),
+		int16(WhitePawn)*64 + int16(D2),
+	}
+	if !sameArray16(input, expected) {
+		t.Errorf("Position is encoded wrong, expected %v, got %v", expected, input)
+	}
+}
+
+func TestFactorized(t *testing.T) {
+	features := NewFactorized(NewKingBucketed(NewKingBuckets(2, false), false))
+
+	pos := ParseFen("4k3/8/8/8/8/8/4P3/4K3 w - - 0 1")
+	input := features.Encode(&pos)
+
+	// Each perspective has the real pawn feature followed by its virtual
+	// piece square feature, which is numbered after all the real features
+	expected := []int16{12, 1280 + 12, 5*64 + 52, 1280 + 5*64 + 52}
+	if !sameArray16(input, expected) {
+		t.Errorf("Position is encoded wrong, expected %v, got %v", expected, input)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	kb := NewKingBuckets(32, true)
+	sets := []FeatureSet{
+		PieceSquare{},
+		PerspectivePieceSquare{},
+		NewKingBucketed(kb, true),
+		NewFactorized(NewKingBucketed(kb, true)),
+	}
+	fens := []string{
+		"8/8/8/8/8/8/3kP3/7K b - - 0 1",
+		"r3k2r/6P1/8/3pP3/8/8/8/R3K2R w KQkq d6 3 42",
+		"5k2/ppp5/4P3/3R3p/6P1/1K2Nr2/PP3P2/8 b - - 1 32",
+	}
+	for _, features := range sets {
+		if !CanDecode(features) {
+			t.Errorf("Feature set %s should be decodable", features.Name())
+		}
+		for _, fen := range fens {
+			pos := ParseFen(fen)
+			input := features.Encode(&pos)
+			decoded := features.(Decoder).Decode(input)
+			if !sameFeatures(input, features.Encode(&decoded)) {
+				t.Errorf("Decoding %s with %s results in a different input", fen, features.Name())
+			}
+		}
+	}
+
+	if CanDecode(NewKingBucketed(kb, false)) {
+		t.Errorf("HalfKP has no king features, and can not be decodable")
+	}
+}
+
+// sameFeatures compares the features of each half, regardless of their order
+func sameFeatures(expected, actual []int16) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	sorted := func(input []int16) []int16 {
+		half := len(input) / 2
+		sorted := append([]int16{}, input...)
+		sort.Slice(sorted[:half], func(i, j int) bool { return sorted[i] < sorted[j] })
+		sort.Slice(sorted[half:], func(i, j int) bool { return sorted[half+i] < sorted[half+j] })
+		return sorted
+	}
+	return sameArray16(sorted(expected), sorted(actual))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+type (
+	// Filter drops the samples that it does not keep, pos is nil for samples
+	// whose position is not known, i.e. samples of binpacks of features.
+	// Filters that need the position keep such samples
+	Filter struct {
+		Name    string
+		Keep    func(sample *Data, pos *Position) bool
+		removed int64
+	}
+)
+
+// Filters are applied to all the samples that are read, in order, a sample is
+// dropped by the first filter that does not keep it
+var Filters []*Filter
+
+// keepSample applies the filters to the sample, and counts the samples that
+// each filter drops
+func keepSample(sample *Data, pos *Position) bool {
+	for _, filter := range Filters {
+		if !filter.Keep(sample, pos) {
+			atomic.AddInt64(&filter.removed, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// printFiltered prints the number of samples that each filter dropped since
+// the last call
+func printFiltered() {
+	for _, filter := range Filters {
+		removed := atomic.SwapInt64(&filter.removed, 0)
+		fmt.Printf("Filter %s removed %d samples\n", filter.Name, removed)
+	}
+}
+
+// resetFiltered forgets the samples that the filters dropped, for the inputs
+// that are read more than once
+func resetFiltered() {
+	for _, filter := range Filters {
+		atomic.StoreInt64(&filter.removed, 0)
+	}
+}
+
+// ScoreFilter keeps the samples with scores in [min, max]
+func ScoreFilter(min, max int) *Filter {
+	return &Filter{
+		Name: fmt.Sprintf("score in [%d, %d]", min, max),
+		Keep: func(sample *Data, _ *Position) bool {
+			return int(sample.Score) >= min && int(sample.Score) <= max
+		},
+	}
+}
+
+// MateFilter drops the samples with mate scores, that is scores whose
+// absolute value is at least the mate score
+func MateFilter(mateScore int) *Filter {
+	return &Filter{
+		Name: fmt.Sprintf("mate scores (%d)", mateScore),
+		Keep: func(sample *Data, _ *Position) bool {
+			return int(sample.Score) < mateScore && int(sample.Score) > -mateScore
+		},
+	}
+}
+
+// PiecesFilter keeps the samples with [min, max] pieces, kings included
+func PiecesFilter(min, max int) *Filter {
+	return &Filter{
+		Name: fmt.Sprintf("pieces in [%d, %d]", min, max),
+		Keep: func(sample *Data, pos *Position) bool {
+			var pieces int
+			if pos != nil {
+				pieces = pos.PieceCount()
+			} else {
+				pieces = Features.Pieces(sample.Input)
+			}
+			return pieces >= min && pieces <= max
+		},
+	}
+}
+
+// CheckFilter drops the positions where the side to move is in check
+func CheckFilter() *Filter {
+	return &Filter{
+		Name: "in check",
+		Keep: func(_ *Data, pos *Position) bool {
+			return pos == nil || !pos.InCheck()
+		},
+	}
+}
+
+// SideToMoveFilter keeps the positions where the given color is to move
+func SideToMoveFilter(color Color) *Filter {
+	name := "white to move"
+	if color == Black {
+		name = "black to move"
+	}
+	return &Filter{
+		Name: name,
+		Keep: func(_ *Data, pos *Position) bool {
+			return pos == nil || pos.SideToMove == color
+		},
+	}
+}
+
+// FullMoveFilter keeps the positions with full move numbers in [min, max],
+// and the positions whose clocks are not known
+func FullMoveFilter(min, max int) *Filter {
+	return &Filter{
+		Name: fmt.Sprintf("full move in [%d, %d]", min, max),
+		Keep: func(_ *Data, pos *Position) bool {
+			return pos == nil || !pos.HasClocks || (int(pos.FullMoveNumber) >= min && int(pos.FullMoveNumber) <= max)
+		},
+	}
+}
+
+// DisagreementFilter drops the samples where the score, as a win
+// probability, and the outcome differ by more than maxDifference
+func DisagreementFilter(maxDifference float64) *Filter {
+	return &Filter{
+		Name: fmt.Sprintf("score and outcome disagree by more than %g", maxDifference),
+		Keep: func(sample *Data, _ *Position) bool {
+			difference := Sigmoid(float32(sample.Score)) - float32(sample.Outcome)/2
+			return math.Abs(float64(difference)) <= maxDifference
+		},
+	}
+}
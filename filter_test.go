@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	defer func(filters []*Filter) { Filters = filters }(Filters)
+
+	path := filepath.Join(t.TempDir(), "filter.epd")
+	lines := []string{
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:31000;eval:0;qs:0;outcome:1.0",
+		"4k3/8/8/8/1b6/8/8/4K3 w - - 0 1;score:-10;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 b - - 0 1;score:10;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 90;score:10;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:900;eval:0;qs:0;outcome:0.0",
+		"4k3/8/8/8/8/8/8/4K3 w - - 0 1;score:0;eval:0;qs:0;outcome:0.5",
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		f.WriteString(line + "\n")
+	}
+	f.Close()
+
+	Filters = []*Filter{
+		MateFilter(30000),
+		CheckFilter(),
+		SideToMoveFilter(White),
+		FullMoveFilter(0, 80),
+		DisagreementFilter(0.8),
+		PiecesFilter(3, 32),
+	}
+	reader := openSamples([]string{path})
+	data := make([]Data, 0)
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		data = append(data, sample)
+	}
+	reader.Close()
+
+	if len(data) != 1 || data[0].Score != 10 {
+		t.Errorf("Expected only the first sample, got %v", data)
+	}
+	for _, filter := range Filters {
+		if removed := atomic.LoadInt64(&filter.removed); removed != 1 {
+			t.Errorf("Filter %s removed %d samples, expected 1", filter.Name, removed)
+		}
+	}
+
+	// Positions without clocks are not judged by their full move number, and
+	// mate scores beyond 16 bits keep every score
+	keep := func(filter *Filter, sample Data, fen string) bool {
+		pos := ParseFen(fen)
+		return filter.Keep(&sample, &pos)
+	}
+	if !keep(FullMoveFilter(10, 80), Data{}, "4k3/8/8/8/8/8/4P3/4K3 w - -") {
+		t.Errorf("Expected the position without clocks to be kept")
+	}
+	if keep(FullMoveFilter(10, 80), Data{}, "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1") {
+		t.Errorf("Expected the first move to be dropped")
+	}
+	if !keep(MateFilter(40000), Data{Score: 32000}, "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1") {
+		t.Errorf("Expected a score below the mate score to be kept")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Format is the layout of the samples of text datasets
+type Format uint32
+
+const (
+	// FengenFormat is FEN;score:..;eval:..;qs:..;outcome:.. lines, the score
+	// and the outcome are relative to the side to move
+	FengenFormat Format = iota
+	// EPDFormat is FEN [result] lines, optionally followed by the score. The
+	// result and the score are relative to white
+	EPDFormat
+	// PipeFormat is FEN | score | result lines, the score and the result are
+	// relative to white
+	PipeFormat
+	// C9Format is EPD lines with the result in the c9 opcode, and optionally
+	// the score in the ce opcode. The result is relative to white and the
+	// score to the side to move
+	C9Format
+	// PlainFormat is the blocks of the plain format of Stockfish, a fen,
+	// move, score, ply and result line followed by an e line. The score and
+	// the result are relative to the side to move
+	PlainFormat
+)
+
+var formatNames = []string{"fengen", "epd", "pipe", "c9", "plain"}
+
+// TextFormat is the format of all the text inputs
+var TextFormat = FengenFormat
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+func ParseFormat(name string) Format {
+	return Format(indexOf(formatNames, name))
+}
+
+// parseResult parses a game result relative to white, either as a score
+// (1.0, 0.5 and 0.0) or in PGN notation (1-0, 1/2-1/2 and 0-1)
+func parseResult(value string) (int8, error) {
+	switch value {
+	case "0.0", "0", "0-1":
+		return 0, nil
+	case "0.5", "1/2-1/2":
+		return 1, nil
+	case "1.0", "1", "1-0":
+		return 2, nil
+	}
+	return 0, &ParseError{BadOutcome, fmt.Sprintf("result %s is not one of 1.0, 0.5, 0.0, 1-0, 1/2-1/2 and 0-1", value)}
+}
+
+// fromWhite makes the score and the outcome, relative to white, relative to
+// the side to move of the position
+func fromWhite(pos *Position, score int16, outcome int8) Data {
+	if pos.SideToMove == Black {
+		score, outcome = -score, 2-outcome
+	}
+	return newSample(score, outcome)
+}
+
+func parseEPD(line string) (data Data, pos Position, err error) {
+	open := strings.Index(line, "[")
+	end := strings.Index(line, "]")
+	if open == -1 || end < open {
+		return data, pos, &ParseError{MissingField, "expected the FEN followed by the [result]"}
+	}
+	pos, fenErr := TryParseFen(line[:open])
+	if fenErr != nil {
+		return data, pos, &ParseError{BadFen, fenErr.Error()}
+	}
+	outcome, err := parseResult(strings.TrimSpace(line[open+1 : end]))
+	if err != nil {
+		return data, pos, err
+	}
+	score := int16(0)
+	if value := strings.TrimSpace(line[end+1:]); value != "" {
+		if score, err = parseScore(value); err != nil {
+			return data, pos, err
+		}
+	}
+	return fromWhite(&pos, score, outcome), pos, nil
+}
+
+func parsePipe(line string) (data Data, pos Position, err error) {
+	fields := strings.Split(line, "|")
+	if len(fields) != 3 {
+		return data, pos, &ParseError{MissingField, "expected FEN | score | result"}
+	}
+	pos, fenErr := TryParseFen(fields[0])
+	if fenErr != nil {
+		return data, pos, &ParseError{BadFen, fenErr.Error()}
+	}
+	score, err := parseScore(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return data, pos, err
+	}
+	outcome, err := parseResult(strings.TrimSpace(fields[2]))
+	if err != nil {
+		return data, pos, err
+	}
+	return fromWhite(&pos, score, outcome), pos, nil
+}
+
+func parseC9(line string) (data Data, pos Position, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return data, pos, &ParseError{MissingField, "expected the EPD followed by the c9 opcode"}
+	}
+	// EPDs have no clocks, they are hmvc and fmvn opcodes instead. The clocks
+	// are only known when there is a full move number
+	pos, fenErr := TryParseFen(strings.Join(fields[:4], " "))
+	if fenErr != nil {
+		return data, pos, &ParseError{BadFen, fenErr.Error()}
+	}
+
+	opcodes := make(map[string]string)
+	for _, operation := range strings.Split(strings.Join(fields[4:], " "), ";") {
+		operation = strings.TrimSpace(operation)
+		name, operand := operation, ""
+		if i := strings.Index(operation, " "); i != -1 {
+			name, operand = operation[:i], strings.Trim(strings.TrimSpace(operation[i+1:]), "\"")
+		}
+		opcodes[name] = operand
+	}
+
+	if value, ok := opcodes["hmvc"]; ok {
+		clock, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return data, pos, &ParseError{BadFen, fmt.Sprintf("half move clock %s is not a 16 bits number", value)}
+		}
+		pos.HalfMoveClock = uint16(clock)
+	}
+	if value, ok := opcodes["fmvn"]; ok {
+		number, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || number == 0 {
+			return data, pos, &ParseError{BadFen, fmt.Sprintf("full move number %s is not a positive 16 bits number", value)}
+		}
+		pos.FullMoveNumber = uint16(number)
+		pos.HasClocks = true
+	}
+
+	result, ok := opcodes["c9"]
+	if !ok {
+		return data, pos, &ParseError{MissingField, "no c9 opcode"}
+	}
+	outcome, err := parseResult(result)
+	if err != nil {
+		return data, pos, err
+	}
+	score := int16(0)
+	if value, ok := opcodes["ce"]; ok {
+		if score, err = parseScore(value); err != nil {
+			return data, pos, err
+		}
+	}
+	if pos.SideToMove == Black {
+		outcome = 2 - outcome
+	}
+	return newSample(score, outcome), pos, nil
+}
+
+// parsePlain parses a block of the plain format, its lines are separated by
+// line breaks
+func parsePlain(block string) (data Data, pos Position, err error) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(block, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, " "); i != -1 {
+			values[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	for _, name := range []string{"fen", "score", "result"} {
+		if _, ok := values[name]; !ok {
+			return data, pos, &ParseError{MissingField, "no " + name}
+		}
+	}
+	pos, fenErr := TryParseFen(values["fen"])
+	if fenErr != nil {
+		return data, pos, &ParseError{BadFen, fenErr.Error()}
+	}
+	score, err := parseScore(values["score"])
+	if err != nil {
+		return data, pos, err
+	}
+	var outcome int8
+	switch values["result"] {
+	case "-1":
+		outcome = 0
+	case "0":
+		outcome = 1
+	case "1":
+		outcome = 2
+	default:
+		return data, pos, &ParseError{BadOutcome, fmt.Sprintf("result %s is not one of -1, 0 and 1", values["result"])}
+	}
+	return newSample(score, outcome), pos, nil
+}
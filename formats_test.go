@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	defer func(format Format) { TextFormat = format }(TextFormat)
+
+	white := "4k3/8/8/8/8/8/4P3/4K3 w - -"
+	black := "4k3/8/8/8/8/8/4P3/4K3 b - -"
+	lines := map[Format][]string{
+		FengenFormat: {
+			white + " 0 1;score:50;eval:0;qs:0;outcome:1.0",
+			black + " 0 1;score:-50;eval:0;qs:0;outcome:0.0",
+		},
+		EPDFormat: {
+			white + " [1.0] 50",
+			black + " 0 1 [1-0] 50",
+		},
+		PipeFormat: {
+			white + " 0 1 | 50 | 1.0",
+			black + " 0 1 | 50 | 1-0",
+		},
+		C9Format: {
+			white + ` c9 "1-0"; ce 50;`,
+			black + ` hmvc 3; fmvn 12; c9 "1-0"; ce -50;`,
+		},
+	}
+	expected := []Data{
+		{Input: FromFen(white), Score: 50, Outcome: 2},
+		{Input: FromFen(black), Score: -50, Outcome: 0},
+	}
+	for format, samples := range lines {
+		TextFormat = format
+		for i, line := range samples {
+			data := ParseLine(line)
+			if data.Score != expected[i].Score || data.Outcome != expected[i].Outcome || !sameFeatures(data.Input, expected[i].Input) {
+				t.Errorf("%s: expected %v, got %v", format, expected[i], data)
+			}
+		}
+	}
+
+	// The clocks of c9 lines are in the hmvc and fmvn opcodes
+	TextFormat = C9Format
+	if _, pos, err := parseLine(lines[C9Format][1]); err != nil || !pos.HasClocks || pos.HalfMoveClock != 3 || pos.FullMoveNumber != 12 {
+		t.Errorf("Expected the clocks 3 and 12, got %d and %d (%v)", pos.HalfMoveClock, pos.FullMoveNumber, err)
+	}
+	if _, pos, err := parseLine(lines[C9Format][0]); err != nil || pos.HasClocks {
+		t.Errorf("Expected unknown clocks without opcodes, got %v (%v)", pos, err)
+	}
+	for _, opcodes := range []string{` hmvc x; c9 "1-0";`, ` fmvn 0; c9 "1-0";`, ` fmvn 70000; c9 "1-0";`} {
+		if _, err := TryParseLine(black + opcodes); err == nil || err.(*ParseError).Category != BadFen {
+			t.Errorf("Expected the clocks of %s to be rejected, got %v", opcodes, err)
+		}
+	}
+
+	TextFormat = EPDFormat
+	if data := ParseLine(white + " [0.5]"); data.Score != 0 || data.Outcome != 1 {
+		t.Errorf("Expected a draw without a score, got %v", data)
+	}
+	for _, format := range []Format{EPDFormat, PipeFormat, C9Format} {
+		TextFormat = format
+		if _, err := TryParseLine(white + " 0 1"); err == nil {
+			t.Errorf("%s: expected an error for a line without a result", format)
+		}
+	}
+}
+
+func TestPlainFormat(t *testing.T) {
+	defer func(format Format) { TextFormat = format }(TextFormat)
+	TextFormat = PlainFormat
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.plain")
+	second := filepath.Join(dir, "second.plain")
+	blocks := "fen 4k3/8/8/8/8/8/4P3/4K3 w - - 0 1\nmove e2e4\nscore 50\nply 10\nresult 1\ne\n" +
+		"fen 4k3/8/8/8/8/8/4P3/4K3 b - - 0 1\nmove e8d7\nscore -50\nply 11\nresult -1\ne\n"
+	if err := os.WriteFile(first, []byte(blocks+"fen 4k3/8/8/8/8/8/4P3/4K3 w - - 0 1\nmove e2e4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte(blocks), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(strict bool) { StrictParsing = strict }(StrictParsing)
+	StrictParsing = false
+	reader := openSamples([]string{first, second})
+	defer reader.Close()
+	scores := make([]int16, 0)
+	outcomes := make([]int8, 0)
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		scores = append(scores, sample.Score)
+		outcomes = append(outcomes, sample.Outcome)
+	}
+	if len(scores) != 4 || scores[0] != 50 || scores[1] != -50 || outcomes[0] != 2 || outcomes[1] != 0 {
+		t.Errorf("Unexpected samples with scores %v and outcomes %v", scores, outcomes)
+	}
+	if skipped := reader.Skipped(); skipped[MissingField] != 1 {
+		t.Errorf("Expected the truncated block to be skipped, got %v", skipped)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type (
+	// Initializer decides the scale of the initial weights of a layer
+	Initializer uint32
+
+	// Distribution is the distribution the initial weights are drawn from
+	Distribution uint32
+)
+
+const (
+	// LegacyInitializer draws all the weights from [0, 2/sqrt(inputs)], or
+	// from a normal distribution with a standard deviation of 1/sqrt(inputs),
+	// where inputs is the number of inputs of the network regardless of the
+	// layer
+	LegacyInitializer Initializer = iota
+	// HeInitializer (Kaiming) scales the weights by the fan-in of the layer,
+	// and suits ReLU-like activations
+	HeInitializer
+	// XavierInitializer (Glorot) scales the weights by the fan-in and the
+	// fan-out of the layer, and suits linear and sigmoid activations
+	XavierInitializer
+)
+
+const (
+	UniformDistribution Distribution = iota
+	NormalDistribution
+)
+
+var initializerNames = []string{"legacy", "he", "xavier"}
+var distributionNames = []string{"uniform", "normal"}
+
+var (
+	WeightInitializer  = LegacyInitializer
+	WeightDistribution = UniformDistribution
+	// ZeroBiases starts all the biases at zero, otherwise they are drawn like
+	// the weights
+	ZeroBiases = false
+	// Random is the source of the initial weights, seed it with SeedRandom to
+	// get reproducible networks
+	Random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func (i Initializer) String() string {
+	return initializerNames[i]
+}
+
+func (d Distribution) String() string {
+	return distributionNames[d]
+}
+
+func ParseInitializer(name string) Initializer {
+	return Initializer(indexOf(initializerNames, name))
+}
+
+func ParseDistribution(name string) Distribution {
+	return Distribution(indexOf(distributionNames, name))
+}
+
+func SeedRandom(seed int64) {
+	Random = rand.New(rand.NewSource(seed))
+}
+
+// stddev is the standard deviation of the weights of a layer
+func (i Initializer) stddev(fanIn, fanOut uint32) float64 {
+	if i == XavierInitializer {
+		return math.Sqrt(2.0 / float64(fanIn+fanOut))
+	}
+	return math.Sqrt(2.0 / float64(fanIn))
+}
+
+// randomArray draws the initial weights of a layer with the given fan-in and
+// fan-out, inputs is the number of inputs of the network
+func randomArray(size, fanIn, fanOut, inputs uint32) []float32 {
+	data := make([]float32, size)
+	if WeightInitializer == LegacyInitializer {
+		for i := uint32(0); i < size; i++ {
+			if WeightDistribution == NormalDistribution {
+				data[i] = float32(Random.NormFloat64() / math.Sqrt(float64(inputs)))
+			} else {
+				data[i] = float32(Random.Float64() * 2.0 / math.Sqrt(float64(inputs)))
+			}
+		}
+		return data
+	}
+
+	stddev := WeightInitializer.stddev(fanIn, fanOut)
+	for i := uint32(0); i < size; i++ {
+		if WeightDistribution == NormalDistribution {
+			data[i] = float32(Random.NormFloat64() * stddev)
+		} else {
+			// A uniform distribution over [-a, a] has a standard deviation
+			// of a / sqrt(3)
+			limit := stddev * math.Sqrt(3)
+			data[i] = float32((2*Random.Float64() - 1) * limit)
+		}
+	}
+	return data
+}
+
+// initialBiases returns the initial biases of a layer
+func initialBiases(size, fanIn, fanOut, inputs uint32) []float32 {
+	if ZeroBiases {
+		return make([]float32, size)
+	}
+	return randomArray(size, fanIn, fanOut, inputs)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type (
+	// Target decides what an output of the network is trained to predict
+	Target uint32
+
+	// Loss is the loss function of an output of the network
+	Loss uint32
+
+	// OutputHead is the target and loss of an output of the network
+	OutputHead struct {
+		Target Target
+		Loss   Loss
+	}
+)
+
+const (
+	// BlendTarget is the mix of the eval and the outcome, weighted by
+	// CostEvalWeight and CostWDLWeight
+	BlendTarget Target = iota
+	// EvalTarget is the score of the position, squashed by Sigmoid
+	EvalTarget
+	// WDLTarget is the outcome of the game, 0 for loss, 0.5 for draw and 1 for
+	// win
+	WDLTarget
+)
+
+const (
+	MeanSquaredError Loss = iota
+	// CrossEntropy expects the output to be a probability
+	CrossEntropy
+)
+
+var targetNames = []string{"blend", "eval", "wdl"}
+var lossNames = []string{"mse", "ce"}
+
+func (t Target) String() string {
+	if int(t) < len(targetNames) {
+		return targetNames[t]
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+func (l Loss) String() string {
+	if int(l) < len(lossNames) {
+		return lossNames[l]
+	}
+	return fmt.Sprintf("unknown(%d)", l)
+}
+
+func (h OutputHead) String() string {
+	return fmt.Sprintf("%s:%s", h.Target, h.Loss)
+}
+
+// ParseOutputHead parses a head in the form of target[:loss], the loss is mse
+// by default
+func ParseOutputHead(head string) OutputHead {
+	words := strings.SplitN(head, ":", 2)
+	h := OutputHead{Target: Target(indexOf(targetNames, words[0]))}
+	if len(words) == 2 {
+		h.Loss = Loss(indexOf(lossNames, words[1]))
+	}
+	return h
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("Unknown name %s, expected one of %s", name, names))
+}
+
+// DefaultOutputHeads trains every output to predict the blend of the eval and
+// the outcome
+func DefaultOutputHeads(outputs uint32) []OutputHead {
+	return make([]OutputHead, outputs)
+}
+
+func (h OutputHead) target(evalTarget, wdlTarget float32) float32 {
+	switch h.Target {
+	case EvalTarget:
+		return evalTarget
+	case WDLTarget:
+		return wdlTarget
+	}
+	return CostEvalWeight*evalTarget + CostWDLWeight*wdlTarget
+}
+
+// Gradient is the derivative of the loss with respect to the output
+func (h OutputHead) Gradient(output, evalTarget, wdlTarget float32) float32 {
+	if h.Loss == CrossEntropy {
+		target := h.target(evalTarget, wdlTarget)
+		return (output - target) / float32(math.Max(float64(output*(1-output)), 1e-6))
+	}
+	if h.Target == BlendTarget {
+		return CalculateCostGradient(output, evalTarget, wdlTarget)
+	}
+	return 2.0 * (output - h.target(evalTarget, wdlTarget))
+}
+
+// Cost is the loss of the output
+func (h OutputHead) Cost(output, evalTarget, wdlTarget float32) float32 {
+	if h.Loss == CrossEntropy {
+		target := float64(h.target(evalTarget, wdlTarget))
+		y := math.Min(math.Max(float64(output), 1e-6), 1-1e-6)
+		return float32(-(target*math.Log(y) + (1-target)*math.Log(1-y)))
+	}
+	if h.Target == BlendTarget {
+		return ValidationCost(output, evalTarget, wdlTarget)
+	}
+	return float32(math.Pow(float64(output-h.target(evalTarget, wdlTarget)), 2.0))
+}
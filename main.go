@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
 	_ "net/http/pprof"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 
 	"strings"
+	"time"
 )
 
 var (
@@ -27,14 +29,57 @@ func main() {
 	inputs := flag.Int("inputs", DefaultNumberOfInputs, "Number of inputs")
 	neurons := flag.String("hiddens", DefaultNumberOfHiddenNeurons, "Number of hidden neurons, for multi-layer you can send comma separated numbers")
 	outputs := flag.Int("outputs", DefaultNumberOfOutputs, "Number of outputs")
+	heads := flag.String("heads", "", "Comma separated target[:loss] of each output, the target is one of blend, eval and wdl and the loss is one of mse and ce. By default all outputs are trained against the blend with mse")
+	initializer := flag.String("init", LegacyInitializer.String(), "Weight initializer, one of legacy, he and xavier")
+	distribution := flag.String("init-distribution", UniformDistribution.String(), "Distribution of the initial weights, one of uniform and normal")
+	zeroBiases := flag.Bool("zero-biases", false, "Start all the biases at zero")
+	seed := flag.Int64("seed", 0, "Seed of the initial weights, 0 picks a random seed")
+	psqt := flag.Bool("psqt", false, "Add a skip connection from the inputs straight to the output layer")
+	outputBuckets := flag.Int("output-buckets", 1, "Number of output buckets, the bucket of each position is selected by the number of pieces on the board")
+	activations := flag.String("activations", "", "Comma separated activation of each layer, one of relu, crelu, screlu, linear and sigmoid. By default the hidden layers use relu and the output layer uses sigmoid")
 	learningRate := flag.Float64("lr", float64(LearningRate), "Learning Rate")
 	sigmoidScale := flag.Float64("sigmoid-scale", float64(SigmoidScale), "Sigmoid scale")
 	networkId := flag.Int("network-id", int(uint32(rand.Int())), "A unique id for the network")
-	epdPath := flag.String("input-path", "", "Path to input dataset (FENs), for multiple files send a comma separated set of files")
+	epdPath := flag.String("input-path", "", "Path to input dataset, for multiple files send a comma separated set of files, directories and glob patterns. Text (FENs) and binpack files can be mixed, binpacks are detected by their header or by the .bin and .binpack extensions. Gzip compressed inputs are decompressed on the fly")
 	startNet := flag.String("from-net", "", "Path to a network, to be used as a starting point")
 	binPath := flag.String("output-path", "", "Final NNUE path directory")
-	storeBin := flag.String("output-binpack", "", "Path to store binpack representation")
-	readBinpack := flag.Bool("b", false, "Read input as a binpack")
+	storeBin := flag.String("output-binpack", "", "Path to store binpack representation of all the inputs. The binpack stores the positions, so that it can be loaded with any feature set, unless some inputs are binpacks of features (v1 and v2), then it stores the features")
+	dedup := flag.String("dedup", KeepDuplicates.String(), "How the repeated positions (board and side to move) are deduplicated when storing a binpack or with -binpack-tool dedup, one of none, first, average-scores and average-outcomes. The kept sample is the first one of its position, with the mean score or outcome of all of its samples for the average policies")
+	compress := flag.Bool("compress", false, "Compress the blocks of the stored binpack")
+	format := flag.String("format", FengenFormat.String(), "Format of the text inputs, one of fengen (FEN;score:..;eval:..;qs:..;outcome:..), epd (FEN [result] score), pipe (FEN | score | result), c9 (EPD with c9 and ce opcodes) and plain (Stockfish plain blocks)")
+	readBinpack := flag.Bool("b", false, "Read all the inputs as binpacks, regardless of their extension")
+	lenient := flag.Bool("lenient", false, "Skip the lines of text inputs that can not be parsed, instead of stopping at the first one. The skipped lines are counted and summarized after loading")
+	minScore := flag.Int("min-score", math.MinInt16, "Drop the samples with lower scores")
+	maxScore := flag.Int("max-score", math.MaxInt16, "Drop the samples with higher scores")
+	mateScore := flag.Int("mate-score", 0, "Drop the samples whose absolute score is at least this, 0 keeps mate scores")
+	minPieces := flag.Int("min-pieces", 2, "Drop the positions with fewer pieces, kings included")
+	maxPieces := flag.Int("max-pieces", 32, "Drop the positions with more pieces, kings included")
+	skipCheck := flag.Bool("skip-check", false, "Drop the positions where the side to move is in check (not applied to binpacks of features)")
+	sideToMove := flag.String("side-to-move", "", "Keep only the positions where white or black is to move (not applied to binpacks of features)")
+	minFullMove := flag.Int("min-fullmove", 0, "Drop the positions with lower full move numbers (not applied to binpacks of features and positions without clocks)")
+	maxFullMove := flag.Int("max-fullmove", 0, "Drop the positions with higher full move numbers, 0 keeps all of them (not applied to binpacks of features and positions without clocks)")
+	maxDisagreement := flag.Float64("max-disagreement", 0, "Drop the samples where the score, as a win probability, and the outcome differ by more than this, 0 keeps all of them")
+	drawWeight := flag.Float64("draw-weight", 1, "Weight of the drawn samples in the loss, 0 leaves them out of the loss")
+	openingPlies := flag.Int("opening-plies", 0, "Number of plies at the start of the games over which the weight of the positions ramps up linearly to 1 (not applied to binpacks of features)")
+	scoreWeightScale := flag.Float64("score-weight-scale", 0, "Scale the weight of the samples down by their absolute score, a sample with this score weighs half as much as a sample with a score of 0. 0 keeps the weights")
+	parsingThreads := flag.Int("parsing-threads", ParsingThreads, "Number of threads that parse the text inputs")
+	singlePass := flag.Bool("single-pass", false, "Load the text inputs in a single pass, without counting their samples first")
+	stream := flag.Bool("stream", false, "Stream the training samples from disk every epoch, instead of loading them all into memory")
+	shuffleBuffer := flag.Int("shuffle-buffer", 1_000_000, "Number of samples that are shuffled together when streaming, and by the shuffle binpack tool")
+	validationSamples := flag.Int("validation-samples", 1_000_000, "Number of samples at the start of the dataset that are kept for validation when streaming")
+	perspective := flag.Bool("perspective", false, "Use two accumulators, one from each side's perspective, -inputs is ignored")
+	features := flag.String("features", PieceSquareFeatures.String(), "Input feature set, one of piece-square, halfkp and halfka. King bucketed feature sets imply -perspective")
+	kingBuckets := flag.Int("king-buckets", 32, "Number of king buckets of halfkp and halfka, a power of two")
+	factorize := flag.Bool("factorize", false, "Train king bucketed feature sets alongside virtual piece-square features, that are merged into the real features when the network is saved")
+	mirrorKings := flag.Bool("mirror-kings", true, "Mirror the king buckets horizontally, so that only the a-d files get their own buckets")
+	augment := flag.String("augment", "", "Comma separated data augmentations that are applied on the fly while training, flip adds the color-flipped twin of every sample and mirror the horizontally mirrored twin of samples without castling rights. The twins keep the score and outcome, which are relative to the side to move, and twins with the same inputs as their sample are dropped")
+	binpackTool := flag.String("binpack-tool", "", "Process the binpack inputs into -output-binpack instead of training, one of merge, dedup (with the -dedup policy), shuffle (out of core, in buckets of -shuffle-buffer samples), split (into training and -validation-binpack) and sample (-sample-size random samples)")
+	validationBinpack := flag.String("validation-binpack", "", "Path to store the validation samples of the split binpack tool")
+	validationRatio := flag.Float64("validation-ratio", 0.1, "Ratio of the samples that the split binpack tool keeps for validation")
+	sampleSize := flag.Int64("sample-size", 1_000_000, "Number of samples that the sample binpack tool picks")
+	stats := flag.Bool("stats", false, "Print the statistics of the inputs, after filtering, instead of training: the outcomes, the scores, the pieces, the side to move, the inputs that are used and the correlation between the scores and the outcomes")
+	featureUsage := flag.String("feature-usage", "", "Path to store the number of samples where each input is used, as index,count lines, when printing the statistics")
+	parity := flag.String("parity", "", "Path to a file of FENs, each optionally followed by moves, to compare incremental accumulator evaluations of the network against full predictions")
 
 	flag.Parse()
 
@@ -65,28 +110,166 @@ func main() {
 		hiddenNeurons[i] = uint32(parsed)
 	}
 
+	WeightInitializer = ParseInitializer(*initializer)
+	WeightDistribution = ParseDistribution(*distribution)
+	ZeroBiases = *zeroBiases
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	SeedRandom(*seed)
+
 	var network Network
 	if *startNet != "" {
 		network = Load(*startNet)
 	} else {
 		topology := NewTopology(uint32(*inputs), uint32(*outputs), hiddenNeurons)
+		if *activations != "" {
+			words := strings.Split(*activations, ",")
+			if len(words) != len(hiddenNeurons)+1 {
+				panic(fmt.Sprintf("Expected %d activations, one for each layer, got %d", len(hiddenNeurons)+1, len(words)))
+			}
+			for i, w := range words {
+				topology.Activations[i] = ParseActivation(w)
+			}
+		}
+		if *heads != "" {
+			words := strings.Split(*heads, ",")
+			if len(words) != *outputs {
+				panic(fmt.Sprintf("Expected %d heads, one for each output, got %d", *outputs, len(words)))
+			}
+			for i, w := range words {
+				topology.Heads[i] = ParseOutputHead(w)
+			}
+		}
+		topology.OutputBuckets = uint32(*outputBuckets)
+		topology.PSQT = *psqt
+		topology.Perspective = *perspective
+		topology.Features = ParseFeatureKind(*features)
+		if topology.Features != PieceSquareFeatures {
+			topology.Perspective = true
+			topology.KingBuckets = uint32(*kingBuckets)
+			topology.MirrorKings = *mirrorKings
+		}
+		if topology.Perspective {
+			topology.Inputs = topology.FeatureSet().Size()
+		}
+		fmt.Printf("Initializing the network with seed %d\n", *seed)
 		network = CreateNetwork(topology, uint32(*networkId))
 	}
 
+	if *factorize {
+		network.Factorize()
+	}
+
+	Features = network.Topology.FeatureSet()
+
+	if *augment != "" {
+		ParseAugmentations(*augment)
+		if !CanDecode(Features) {
+			panic(fmt.Sprintf("Augmentations can not be used with the %s feature set", Features.Name()))
+		}
+	}
+
 	SigmoidScale = float32(*sigmoidScale)
 	LearningRate = float32(*learningRate)
 
+	if *parity != "" {
+		CheckParityFile(&network, *parity)
+		return
+	}
+
 	// go http.ListenAndServe("localhost:6060", nil)
-	if *storeBin != "" {
+	BinpackInputs = *readBinpack
+	TextFormat = ParseFormat(*format)
+	if *parsingThreads < 1 {
+		panic(fmt.Sprintf("The number of parsing threads has to be at least 1, got %d", *parsingThreads))
+	}
+	ParsingThreads = *parsingThreads
+	StrictParsing = !*lenient
+	if *minScore != math.MinInt16 || *maxScore != math.MaxInt16 {
+		Filters = append(Filters, ScoreFilter(*minScore, *maxScore))
+	}
+	if *mateScore != 0 {
+		Filters = append(Filters, MateFilter(*mateScore))
+	}
+	if *minPieces != 2 || *maxPieces != 32 {
+		Filters = append(Filters, PiecesFilter(*minPieces, *maxPieces))
+	}
+	if *skipCheck {
+		Filters = append(Filters, CheckFilter())
+	}
+	switch *sideToMove {
+	case "":
+	case "white":
+		Filters = append(Filters, SideToMoveFilter(White))
+	case "black":
+		Filters = append(Filters, SideToMoveFilter(Black))
+	default:
+		panic(fmt.Sprintf("Unknown side to move %s, expected white or black", *sideToMove))
+	}
+	if *minFullMove != 0 || *maxFullMove != 0 {
+		max := *maxFullMove
+		if max == 0 {
+			max = math.MaxUint16
+		}
+		Filters = append(Filters, FullMoveFilter(*minFullMove, max))
+	}
+	if *maxDisagreement != 0 {
+		Filters = append(Filters, DisagreementFilter(*maxDisagreement))
+	}
+	if *drawWeight != 1 {
+		WeightRules = append(WeightRules, DrawWeight(float32(*drawWeight)))
+	}
+	if *openingPlies != 0 {
+		WeightRules = append(WeightRules, PlyWeight(*openingPlies))
+	}
+	if *scoreWeightScale != 0 {
+		WeightRules = append(WeightRules, ScoreWeight(*scoreWeightScale))
+	}
+	SinglePass = *singlePass
+	if *binpackTool != "" {
+		CompressBinpacks = *compress
+		paths := ExpandPaths(*epdPath)
+		switch *binpackTool {
+		case "merge":
+			MergeBinpacks(paths, *storeBin)
+		case "dedup":
+			Deduplication = ParseDuplicatePolicy(*dedup)
+			DeduplicateBinpacks(paths, *storeBin)
+		case "shuffle":
+			ShuffleBinpacks(paths, *storeBin, *shuffleBuffer)
+		case "split":
+			SplitBinpacks(paths, *storeBin, *validationBinpack, *validationRatio)
+		case "sample":
+			SampleBinpacks(paths, *storeBin, *sampleSize)
+		default:
+			panic(fmt.Sprintf("Unknown binpack tool %s, expected one of merge, dedup, shuffle, split and sample", *binpackTool))
+		}
+	} else if *stats {
+		statistics := CollectStats(ExpandPaths(*epdPath))
+		statistics.Print()
+		if *featureUsage != "" {
+			statistics.WriteFeatureUsage(*featureUsage)
+		}
+	} else if *storeBin != "" {
+		CompressBinpacks = *compress
+		Deduplication = ParseDuplicatePolicy(*dedup)
 		SaveDataset(*epdPath, *storeBin)
 	} else {
-		var dataset []Data
-		if *readBinpack {
-			dataset = LoadBinpack(*epdPath)
+		var training Source
+		var validation []Data
+		if *stream {
+			paths := ExpandPaths(*epdPath)
+			validation = ReadSamples(paths, *validationSamples)
+			training = &Stream{
+				Paths:         paths,
+				Skip:          len(validation),
+				ShuffleBuffer: *shuffleBuffer,
+			}
 		} else {
-			dataset = LoadDataset(*epdPath)
+			training, validation = SplitDataset(LoadDataset(*epdPath))
 		}
-		trainer := NewTrainer(network, dataset, *epochs)
+		trainer := NewTrainer(network, training, validation, *epochs)
 		runtime.GC()
 
 		trainer.Train(*binPath)
@@ -2,11 +2,10 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math"
 	"os"
-
-	"gonum.org/v1/gonum/stat/distuv"
 )
 
 type (
@@ -14,6 +13,35 @@ type (
 		Inputs        uint32
 		Outputs       uint32
 		HiddenNeurons []uint32
+		// Perspective networks run the first layer twice, once for each side,
+		// and feed the concatenation (side to move first) to the next layer
+		Perspective bool
+		// Features is the encoding of the inputs, king bucketed features are
+		// always used with perspective networks
+		Features    FeatureKind
+		KingBuckets uint32
+		MirrorKings bool
+		// Factorized networks have virtual features, which are only used
+		// during training. They are folded into the real features when the
+		// network is saved
+		Factorized bool
+		// Activations has the activation function of each layer
+		Activations []Activation
+		// OutputBuckets is the number of sets of output neurons, one of them
+		// is selected for each position by the number of pieces on the board
+		OutputBuckets uint32
+		// Heads has the target and the loss of each output
+		Heads []OutputHead
+		// PSQT networks have a skip connection from the inputs straight to
+		// the output layer
+		PSQT bool
+	}
+
+	// Section is an architecture extension stored in the header of version 3.0
+	// network files
+	Section struct {
+		Tag     uint32
+		Payload []byte
 	}
 
 	// Network is a neural network with 3 layers
@@ -26,14 +54,43 @@ type (
 		Errors      []Matrix
 		WGradients  []Gradients
 		BGradients  []Gradients
+		// PSQT has a weight for every input and output (of every bucket),
+		// they are summed for the active features and added to the output
+		PSQT          Matrix
+		PSQTGradients Gradients
+		skip          []float32
+
+		// features is the feature set of the topology, see FeatureSet
+		features FeatureSet
+		// bucket is the output bucket selected by the last prediction
+		bucket uint32
+		// batch holds the buffers of the mini-batch kernels, see TrainBatch
+		batch *batch
 	}
 )
 
+const (
+	// MaterialBuckets selects the output bucket by the number of pieces
+	MaterialBuckets uint32 = 0
+)
+
+const (
+	EndSection uint32 = iota
+	PerspectiveSection
+	FeaturesSection
+	ActivationsSection
+	OutputBucketsSection
+	OutputHeadsSection
+	PSQTSection
+)
+
 func NewTopology(inputs, outputs uint32, hiddenNeurons []uint32) Topology {
 	return Topology{
 		Inputs:        inputs,
 		Outputs:       outputs,
 		HiddenNeurons: hiddenNeurons,
+		Activations:   DefaultActivations(len(hiddenNeurons) + 1),
+		Heads:         DefaultOutputHeads(outputs),
 	}
 }
 
@@ -43,6 +100,7 @@ func (n *Network) Copy() *Network {
 		Topology: n.Topology,
 		Weights:  n.Weights,
 		Biases:   n.Biases,
+		PSQT:     n.PSQT,
 	}
 	topology := n.Topology
 	inputSize := topology.Inputs
@@ -58,17 +116,66 @@ func (n *Network) Copy() *Network {
 		} else {
 			outputSize = topology.HiddenNeurons[i]
 		}
-		net.Activations[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		net.Errors[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		net.WGradients[i] = NewGradients(outputSize, inputSize)
-		net.BGradients[i] = NewGradients(outputSize, 1)
-		inputSize = outputSize
+		activationSize := topology.activationSize(i, outputSize)
+		rows := topology.weightRows(i, outputSize)
+		net.Activations[i] = SingletonMatrix(activationSize, make([]float32, activationSize))
+		net.Errors[i] = SingletonMatrix(activationSize, make([]float32, activationSize))
+		net.WGradients[i] = NewGradients(rows, inputSize)
+		net.BGradients[i] = NewGradients(rows, 1)
+		inputSize = activationSize
+	}
+	if topology.PSQT {
+		net.PSQTGradients = NewGradients(n.PSQT.Rows, n.PSQT.Cols)
 	}
 
 	return &net
 }
 
-// CreateNetwork creates a neural network with random weights
+// Fold returns a copy of a factorized network, where the virtual features are
+// merged into the real features. The copy shares all but the first layer
+// weights with the original network
+func (n *Network) Fold() *Network {
+	features := n.Topology.FeatureSet().(*Factorized)
+	net := *n
+	net.Topology.Factorized = false
+	net.Topology.Inputs = features.Base.Size()
+	net.features = nil
+	net.Weights = append([]Matrix{features.Fold(n.Weights[0])}, n.Weights[1:]...)
+	net.WGradients = append([]Gradients{NewGradients(n.Weights[0].Rows, net.Topology.Inputs)}, n.WGradients[1:]...)
+	if net.Topology.PSQT {
+		net.PSQT = features.Fold(n.PSQT)
+		net.PSQTGradients = NewGradients(net.PSQT.Rows, net.PSQT.Cols)
+	}
+	return &net
+}
+
+// Factorize adds virtual features to a network that is not factorized, the
+// virtual weights start at zero so the network keeps producing the same output
+func (n *Network) Factorize() {
+	if n.Topology.Factorized {
+		return
+	}
+	n.Topology.Factorized = true
+	n.features = nil
+	size := n.Topology.FeatureSet().Size()
+	n.Topology.Inputs = size
+	n.Weights[0] = addColumns(n.Weights[0], size)
+	n.WGradients[0] = NewGradients(n.Weights[0].Rows, size)
+	if n.Topology.PSQT {
+		n.PSQT = addColumns(n.PSQT, size)
+		n.PSQTGradients = NewGradients(n.PSQT.Rows, size)
+	}
+}
+
+// addColumns returns a copy of the matrix with zero columns added to it
+func addColumns(m Matrix, cols uint32) Matrix {
+	data := make([]float32, m.Rows*cols)
+	copy(data, m.Data)
+	return NewMatrix(m.Rows, cols, data)
+}
+
+// CreateNetwork creates a neural network with random weights, see
+// WeightInitializer and WeightDistribution
 func CreateNetwork(topology Topology, id uint32) (net Network) {
 	net = Network{
 		Topology: topology,
@@ -91,17 +198,153 @@ func CreateNetwork(topology Topology, id uint32) (net Network) {
 		} else {
 			outputSize = topology.HiddenNeurons[i]
 		}
-		net.Weights[i] = NewMatrix(outputSize, inputSize, randomArray(inputSize*outputSize, float32(topology.Inputs)))
-		net.Biases[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		net.WGradients[i] = NewGradients(outputSize, inputSize)
-		net.BGradients[i] = NewGradients(outputSize, 1)
-		net.Activations[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		net.Errors[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		inputSize = outputSize
+		rows := topology.weightRows(i, outputSize)
+		net.Weights[i] = NewMatrix(rows, inputSize, randomArray(inputSize*rows, inputSize, outputSize, topology.Inputs))
+		net.Biases[i] = SingletonMatrix(rows, initialBiases(rows, inputSize, outputSize, topology.Inputs))
+		net.WGradients[i] = NewGradients(rows, inputSize)
+		net.BGradients[i] = NewGradients(rows, 1)
+		activationSize := topology.activationSize(i, outputSize)
+		net.Activations[i] = SingletonMatrix(activationSize, make([]float32, activationSize))
+		net.Errors[i] = SingletonMatrix(activationSize, make([]float32, activationSize))
+		inputSize = activationSize
+	}
+	if topology.PSQT {
+		// The skip connection starts at zero, and is learned from there
+		rows := topology.weightRows(len(topology.HiddenNeurons), topology.Outputs)
+		net.PSQT = NewMatrix(rows, topology.Inputs, make([]float32, rows*topology.Inputs))
+		net.PSQTGradients = NewGradients(rows, topology.Inputs)
 	}
 	return
 }
 
+// sections returns the architecture sections that describe the topology, it is
+// empty for networks that can be stored in the plain version 2.0 format
+func (t *Topology) sections() []Section {
+	sections := make([]Section, 0)
+	if t.Perspective {
+		sections = append(sections, Section{Tag: PerspectiveSection})
+	}
+	if t.Features != PieceSquareFeatures {
+		payload := make([]byte, 12)
+		binary.LittleEndian.PutUint32(payload[0:], uint32(t.Features))
+		binary.LittleEndian.PutUint32(payload[4:], t.KingBuckets)
+		if t.MirrorKings {
+			binary.LittleEndian.PutUint32(payload[8:], 1)
+		}
+		sections = append(sections, Section{Tag: FeaturesSection, Payload: payload})
+	}
+	defaults := DefaultActivations(len(t.Activations))
+	for i, activation := range t.Activations {
+		if activation != defaults[i] {
+			payload := make([]byte, 4*len(t.Activations))
+			for j, activation := range t.Activations {
+				binary.LittleEndian.PutUint32(payload[4*j:], uint32(activation))
+			}
+			sections = append(sections, Section{Tag: ActivationsSection, Payload: payload})
+			break
+		}
+	}
+	if t.OutputBuckets > 1 {
+		payload := make([]byte, 8)
+		binary.LittleEndian.PutUint32(payload[0:], MaterialBuckets)
+		binary.LittleEndian.PutUint32(payload[4:], t.OutputBuckets)
+		sections = append(sections, Section{Tag: OutputBucketsSection, Payload: payload})
+	}
+	defaultHeads := DefaultOutputHeads(t.Outputs)
+	for i, head := range t.Heads {
+		if head != defaultHeads[i] {
+			payload := make([]byte, 8*len(t.Heads))
+			for j, head := range t.Heads {
+				binary.LittleEndian.PutUint32(payload[8*j:], uint32(head.Target))
+				binary.LittleEndian.PutUint32(payload[8*j+4:], uint32(head.Loss))
+			}
+			sections = append(sections, Section{Tag: OutputHeadsSection, Payload: payload})
+			break
+		}
+	}
+	return sections
+}
+
+// readSections reads the architecture sections of a version 3.0 network file
+// and applies them to the topology, the sections that hold weights are
+// returned to be loaded once the network is created
+func (t *Topology) readSections(f io.Reader) (weights []Section) {
+	buf := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(f, buf)
+		if err != nil {
+			panic(err)
+		}
+		tag := binary.LittleEndian.Uint32(buf[:4])
+		payload := make([]byte, binary.LittleEndian.Uint32(buf[4:]))
+		_, err = io.ReadFull(f, payload)
+		if err != nil {
+			panic(err)
+		}
+		switch tag {
+		case EndSection:
+			return
+		case PerspectiveSection:
+			t.Perspective = true
+		case FeaturesSection:
+			t.Features = FeatureKind(binary.LittleEndian.Uint32(payload[0:]))
+			t.KingBuckets = binary.LittleEndian.Uint32(payload[4:])
+			t.MirrorKings = binary.LittleEndian.Uint32(payload[8:]) != 0
+		case ActivationsSection:
+			for i := range t.Activations {
+				t.Activations[i] = Activation(binary.LittleEndian.Uint32(payload[4*i:]))
+			}
+		case OutputBucketsSection:
+			if scheme := binary.LittleEndian.Uint32(payload[0:]); scheme != MaterialBuckets {
+				panic(fmt.Sprintf("Unknown output bucket scheme %d", scheme))
+			}
+			t.OutputBuckets = binary.LittleEndian.Uint32(payload[4:])
+		case OutputHeadsSection:
+			for i := range t.Heads {
+				t.Heads[i].Target = Target(binary.LittleEndian.Uint32(payload[8*i:]))
+				t.Heads[i].Loss = Loss(binary.LittleEndian.Uint32(payload[8*i+4:]))
+			}
+		case PSQTSection:
+			t.PSQT = true
+			weights = append(weights, Section{Tag: tag, Payload: payload})
+		default:
+			panic(fmt.Sprintf("Unknown network section %d", tag))
+		}
+	}
+}
+
+// weightRows is the number of rows of the weights of the given layer, the
+// output layer has a set of neurons for each output bucket
+func (t *Topology) weightRows(layer int, neurons uint32) uint32 {
+	if layer == len(t.HiddenNeurons) && t.OutputBuckets > 1 {
+		return neurons * t.OutputBuckets
+	}
+	return neurons
+}
+
+// Bucket returns the output bucket of a position with the given number of
+// pieces, kings included
+func (t *Topology) Bucket(pieces int) uint32 {
+	if t.OutputBuckets <= 1 || pieces < 1 {
+		return 0
+	}
+	bucket := uint32(pieces-1) * t.OutputBuckets / 32
+	if bucket >= t.OutputBuckets {
+		return t.OutputBuckets - 1
+	}
+	return bucket
+}
+
+// activationSize is the number of activations the given layer produces, that
+// is twice the number of its neurons for the first layer of perspective
+// networks
+func (t *Topology) activationSize(layer int, neurons uint32) uint32 {
+	if layer == 0 && t.Perspective {
+		return 2 * neurons
+	}
+	return neurons
+}
+
 // Binary specification for the NNUE file:
 // - All the data is stored in little-endian layout
 // - All the matrices are written in column-major
@@ -117,7 +360,45 @@ func CreateNetwork(topology Topology, id uint32) (net Network) {
 // - 4 bytes (int32) for the size of each layer
 // - All weights for a layer, followed by all the biases of the same layer
 // - Other layers follow just like the above point
+//
+// Networks that use any of the extended architectures are stored with
+// version 3.0, which is identical to 2.0 except that a list of sections
+// follows the size of the layers:
+//   - 4 bytes (int32) section tag, 4 bytes (int32) payload size, the payload
+//   - The list is terminated by a section with tag 0 and no payload
+//   - Tag 1 (Perspective): no payload, the first layer is shared between the
+//     two perspectives and its output is twice the size of the layer
+//   - Tag 2 (Features): 4 bytes (int32) feature set, 0 for piece-square, 1 for
+//     HalfKP and 2 for HalfKA, 4 bytes (int32) number of king buckets and 4
+//     bytes (int32) set to 1 when the king buckets are mirrored horizontally
+//   - Tag 3 (Activations): 4 bytes (int32) for the activation of each layer,
+//     0 for ReLU, 1 for clipped ReLU, 2 for squared clipped ReLU, 3 for
+//     linear and 4 for sigmoid. Without it the hidden layers use ReLU and the
+//     output layer uses sigmoid
+//   - Tag 4 (Output buckets): 4 bytes (int32) bucket scheme, 0 is the only
+//     scheme and it selects the bucket by the number of pieces on the board,
+//     kings included, as (pieces - 1) * buckets / 32. Followed by 4 bytes
+//     (int32) number of buckets. The weights and biases of the output layer
+//     have outputs * buckets rows, the rows of each bucket are consecutive
+//   - Tag 5 (Output heads): 4 bytes (int32) target and 4 bytes (int32) loss of
+//     each output. The target is 0 for the blend of eval and outcome, 1 for
+//     eval and 2 for outcome (WDL), and the loss is 0 for mean squared error
+//     and 1 for cross entropy. Without it all the outputs are trained
+//     against the blend with mean squared error
+//   - Tag 6 (PSQT): the weights of the skip connection from the inputs to the
+//     output layer, 4 bytes (float32) for every row of the output layer
+//     (outputs * buckets) and input, column-major. The weights of the active
+//     features are summed and added to the output before its activation, for
+//     perspective networks the sum of the other side is subtracted from the
+//     sum of the side to move, and the difference is halved
+//
+// Factorized networks are folded before they are stored, so their virtual
+// features never make it to the file
 func (n *Network) Save(file string) {
+	if n.Topology.Factorized {
+		n = n.Fold()
+	}
+
 	f, err := os.Create(file)
 	if err != nil {
 		panic(err)
@@ -126,6 +407,10 @@ func (n *Network) Save(file string) {
 
 	// Write headers
 	buf := []byte{66, 90, 2, 0}
+	sections := n.sections()
+	if len(sections) != 0 {
+		buf[2] = 3
+	}
 	_, err = f.Write(buf)
 	if err != nil {
 		panic(err)
@@ -151,6 +436,19 @@ func (n *Network) Save(file string) {
 		panic(err)
 	}
 
+	if len(sections) != 0 {
+		for _, section := range append(sections, Section{Tag: EndSection}) {
+			buf = make([]byte, 8+len(section.Payload))
+			binary.LittleEndian.PutUint32(buf[0:], section.Tag)
+			binary.LittleEndian.PutUint32(buf[4:], uint32(len(section.Payload)))
+			copy(buf[8:], section.Payload)
+			_, err = f.Write(buf)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
 	buf = make([]byte, 4)
 	for i := 0; i < len(n.Activations); i++ {
 		weights := n.Weights[i].Data
@@ -191,9 +489,10 @@ func Load(path string) Network {
 		panic("Magic word does not match expected, exiting")
 	}
 
-	if buf[2] != 2 || buf[3] != 0 {
+	if (buf[2] != 2 && buf[2] != 3) || buf[3] != 0 {
 		panic("Network binary format is not supported")
 	}
+	hasSections := buf[2] == 3
 
 	_, err = io.ReadFull(f, buf)
 	if err != nil {
@@ -222,6 +521,10 @@ func Load(path string) Network {
 	}
 
 	topology := NewTopology(inputs, outputs, neurons)
+	var weightSections []Section
+	if hasSections {
+		weightSections = topology.readSections(f)
+	}
 
 	net := Network{
 		Topology: topology,
@@ -244,7 +547,8 @@ func Load(path string) Network {
 		} else {
 			outputSize = neurons[i]
 		}
-		data := make([]float32, outputSize*inputSize)
+		rows := topology.weightRows(i, outputSize)
+		data := make([]float32, rows*inputSize)
 		for j := 0; j < len(data); j++ {
 			_, err := io.ReadFull(f, buf)
 			if err != nil {
@@ -252,11 +556,12 @@ func Load(path string) Network {
 			}
 			data[j] = math.Float32frombits(binary.LittleEndian.Uint32(buf))
 		}
-		net.Weights[i] = NewMatrix(outputSize, inputSize, data)
-		net.WGradients[i] = NewGradients(outputSize, inputSize)
-		inputSize = outputSize
+		net.Weights[i] = NewMatrix(rows, inputSize, data)
+		net.WGradients[i] = NewGradients(rows, inputSize)
+		activationSize := topology.activationSize(i, outputSize)
+		inputSize = activationSize
 
-		data = make([]float32, outputSize)
+		data = make([]float32, rows)
 		for j := 0; j < len(data); j++ {
 			_, err := io.ReadFull(f, buf)
 			if err != nil {
@@ -264,66 +569,174 @@ func Load(path string) Network {
 			}
 			data[j] = math.Float32frombits(binary.LittleEndian.Uint32(buf))
 		}
-		net.Biases[i] = SingletonMatrix(outputSize, data)
-		net.Activations[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		net.Errors[i] = SingletonMatrix(outputSize, randomArray(outputSize, float32(topology.Inputs)))
-		net.BGradients[i] = NewGradients(outputSize, 1)
+		net.Biases[i] = SingletonMatrix(rows, data)
+		net.Activations[i] = SingletonMatrix(activationSize, make([]float32, activationSize))
+		net.Errors[i] = SingletonMatrix(activationSize, make([]float32, activationSize))
+		net.BGradients[i] = NewGradients(rows, 1)
+	}
+
+	// PSQT is the only section that holds weights
+	for _, section := range weightSections {
+		data := make([]float32, len(section.Payload)/4)
+		for j := 0; j < len(data); j++ {
+			data[j] = math.Float32frombits(binary.LittleEndian.Uint32(section.Payload[4*j:]))
+		}
+		rows := topology.weightRows(len(neurons), outputs)
+		net.PSQT = NewMatrix(rows, topology.Inputs, data)
+		net.PSQTGradients = NewGradients(rows, topology.Inputs)
 	}
 	return net
 }
 
-func (n *Network) Predict(input []int16) float32 {
+// sections returns the sections of the topology, followed by the sections
+// that hold weights
+func (n *Network) sections() []Section {
+	sections := n.Topology.sections()
+	if n.Topology.PSQT {
+		payload := make([]byte, 4*len(n.PSQT.Data))
+		for i, w := range n.PSQT.Data {
+			binary.LittleEndian.PutUint32(payload[4*i:], math.Float32bits(w))
+		}
+		sections = append(sections, Section{Tag: PSQTSection, Payload: payload})
+	}
+	return sections
+}
+
+// FeatureSet returns the feature set of the network
+func (n *Network) FeatureSet() FeatureSet {
+	if n.features == nil {
+		n.features = n.Topology.FeatureSet()
+	}
+	return n.features
+}
+
+func (n *Network) Predict(input []int16) []float32 {
+	n.bucket = 0
+	if n.Topology.OutputBuckets > 1 {
+		n.bucket = n.Topology.Bucket(n.FeatureSet().Pieces(input))
+	}
 
 	// First layer needs special care
-	activationFn := ReLu
+	activationFn := n.Topology.Activations[0].Apply
 	// apply input layer
 	output := n.Activations[0]
 	weight := n.Weights[0]
 	bias := n.Biases[0]
 	output.Reset()
-	for _, i := range input {
-		osize := output.Size()
-		for j := uint32(0); j < osize; j++ {
-			output.Data[j] += weight.Get(j, uint32(i))
-		}
+	if n.Topology.Perspective {
+		// The input holds the features of the side to move followed by the
+		// features of the other side, both halves are of the same length
+		half := len(input) / 2
+		bsize := bias.Size()
+		accumulate(output.Data[:bsize], &weight, input[:half])
+		accumulate(output.Data[bsize:], &weight, input[half:])
+	} else {
+		accumulate(output.Data, &weight, input)
 	}
 	osize := output.Size()
+	bsize := bias.Size()
 	for j := uint32(0); j < osize; j++ {
-		output.Data[j] = activationFn(output.Data[j] + bias.Data[j])
+		output.Data[j] = activationFn(output.Data[j] + bias.Data[j%bsize])
 	}
-	last := len(n.Activations) - 1
 
+	var skip []float32
+	if n.Topology.PSQT {
+		skip = n.skipConnection(input)
+	}
+	return n.propagate(skip)
+}
+
+// propagate runs the dense layers over the activations of the first layer,
+// skip is added to the output layer when it is not nil
+func (n *Network) propagate(skip []float32) []float32 {
+	var output Matrix
 	for l := 1; l < len(n.Activations); l++ {
 		input := n.Activations[l-1]
 		output = n.Activations[l]
 		weight := n.Weights[l]
 		bias := n.Biases[l]
-		if l == last {
-			activationFn = Sigmoid
-		}
+		activationFn := n.Topology.Activations[l].Apply
+		offset := n.rowOffset(l)
 
 		osize := output.Size()
 		for i := uint32(0); i < osize; i++ {
 			output.Data[i] = 0
 			isize := input.Size()
 			for j := uint32(0); j < isize; j++ {
-				output.Data[i] += input.Data[j] * weight.Get(i, j)
+				output.Data[i] += input.Data[j] * weight.Get(offset+i, j)
 			}
 
-			output.Data[i] = activationFn(output.Data[i] + bias.Data[i])
+			if skip != nil && l == len(n.Activations)-1 {
+				output.Data[i] += skip[i]
+			}
+			output.Data[i] = activationFn(output.Data[i] + bias.Data[offset+i])
 		}
 	}
 
-	return output.Data[0] // This makes the assumption that the output layer is always of size 1
+	// The outputs are only valid until the next prediction
+	return output.Data
+}
+
+// skipConnection sums the PSQT weights of the active features for each output
+// of the selected bucket
+func (n *Network) skipConnection(input []int16) []float32 {
+	outputs := n.Topology.Outputs
+	if uint32(len(n.skip)) != outputs {
+		n.skip = make([]float32, outputs)
+	}
+	for i := range n.skip {
+		n.skip[i] = 0
+	}
+
+	offset := n.rowOffset(len(n.Activations) - 1)
+	add := func(features []int16, scale float32) {
+		for _, f := range features {
+			column := n.PSQT.Data[uint32(f)*n.PSQT.Rows+offset:]
+			for i := range n.skip {
+				n.skip[i] += scale * column[i]
+			}
+		}
+	}
+	if n.Topology.Perspective {
+		half := len(input) / 2
+		add(input[:half], 0.5)
+		add(input[half:], -0.5)
+	} else {
+		add(input, 1)
+	}
+	return n.skip
+}
+
+// rowOffset is the first row of the weights of the layer that is used by the
+// last prediction, it is only non-zero for the output layer of networks with
+// output buckets
+func (n *Network) rowOffset(layer int) uint32 {
+	if layer == len(n.Activations)-1 {
+		return n.bucket * n.Topology.Outputs
+	}
+	return 0
+}
+
+// accumulate adds the columns of the first layer weights that correspond to the
+// active features to the output
+func accumulate(output []float32, weight *Matrix, features []int16) {
+	for _, i := range features {
+		column := weight.Data[uint32(i)*weight.Rows : (uint32(i)+1)*weight.Rows]
+		for j := 0; j < len(output); j++ {
+			output[j] += column[j]
+		}
+	}
 }
 
-func (n *Network) FindErrors(outputGradient float32) {
+func (n *Network) FindErrors(outputGradients []float32) {
 	last := len(n.Activations) - 1
-	n.Errors[last].Data[0] = outputGradient
+	copy(n.Errors[last].Data, outputGradients)
 
 	for l := last - 1; l >= 0; l-- {
 		output := n.Activations[l]
+		derivative := n.Topology.Activations[l].Derivative
 		weight := n.Weights[l+1]
+		offset := n.rowOffset(l + 1)
 		outputError := n.Errors[l+1]
 		inputError := n.Errors[l]
 
@@ -332,7 +745,7 @@ func (n *Network) FindErrors(outputGradient float32) {
 			inputError.Data[i] = 0
 			osize := outputError.Size()
 			for j := uint32(0); j < osize; j++ {
-				inputError.Data[i] += outputError.Data[j] * weight.Get(j, i) * ReLuPrime(output.Data[i])
+				inputError.Data[i] += outputError.Data[j] * weight.Get(offset+j, i) * derivative(output.Data[i])
 			}
 		}
 	}
@@ -344,16 +757,19 @@ func (n *Network) UpdateGradients(input []int16) {
 	err := n.Errors[0]
 
 	// First layer needs special care
-	for _, i := range input {
-		esize := err.Size()
-		for j := uint32(0); j < esize; j++ {
-			wGradients.Update(j, uint32(i), err.Data[j])
-		}
+	if n.Topology.Perspective {
+		half := len(input) / 2
+		bsize := bGradients.Size()
+		updateSparseGradients(&wGradients, err.Data[:bsize], input[:half])
+		updateSparseGradients(&wGradients, err.Data[bsize:], input[half:])
+	} else {
+		updateSparseGradients(&wGradients, err.Data, input)
 	}
 
 	esize := err.Size()
+	bsize := bGradients.Size()
 	for j := uint32(0); j < esize; j++ {
-		bGradients.Data[j].Update(err.Data[j])
+		bGradients.Data[j%bsize].Update(err.Data[j])
 	}
 
 	for l := 1; l < len(n.Activations); l++ {
@@ -362,33 +778,91 @@ func (n *Network) UpdateGradients(input []int16) {
 		bGradients = n.BGradients[l]
 		input := n.Activations[l-1]
 		err = n.Errors[l]
+		offset := n.rowOffset(l)
 
-		for i := uint32(0); i < wGradients.Rows; i++ {
+		esize := err.Size()
+		for i := uint32(0); i < esize; i++ {
 			err := err.Data[i]
-			bGradients.Update(i, 0, err)
+			bGradients.Update(offset+i, 0, err)
 			for j := uint32(0); j < wGradients.Cols; j++ {
 				gradient := input.Data[j] * err
-				wGradients.Update(i, j, gradient)
+				wGradients.Update(offset+i, j, gradient)
 			}
 		}
 	}
+
+	if n.Topology.PSQT {
+		n.updateSkipGradients(input)
+	}
+}
+
+// updateSkipGradients updates the gradients of the PSQT weights of the active
+// features, see skipConnection
+func (n *Network) updateSkipGradients(input []int16) {
+	last := len(n.Activations) - 1
+	err := n.Errors[last].Data
+	offset := n.rowOffset(last)
+	update := func(features []int16, scale float32) {
+		for _, f := range features {
+			for i, e := range err {
+				n.PSQTGradients.Update(offset+uint32(i), uint32(f), scale*e)
+			}
+		}
+	}
+	if n.Topology.Perspective {
+		half := len(input) / 2
+		update(input[:half], 0.5)
+		update(input[half:], -0.5)
+	} else {
+		update(input, 1)
+	}
+}
+
+// updateSparseGradients updates the gradients of the first layer weights that
+// correspond to the active features
+func updateSparseGradients(gradients *Gradients, errors []float32, features []int16) {
+	for _, i := range features {
+		for j := 0; j < len(errors); j++ {
+			gradients.Update(uint32(j), uint32(i), errors[j])
+		}
+	}
 }
 
 func (n *Network) Train(input []int16, evalTarget, wdlTarget float32) float32 {
+	return n.TrainWeighted(input, evalTarget, wdlTarget, 1)
+}
+
+// TrainWeighted is Train with the gradients and the cost scaled by the weight
+// of the sample
+func (n *Network) TrainWeighted(input []int16, evalTarget, wdlTarget, weight float32) float32 {
 
 	// First use the net to predict the outcome of the input
 	lastOutput := n.Predict(input)
 
 	// Measure how well did we do
-	outputGradient := CalculateCostGradient(lastOutput, evalTarget, wdlTarget) * SigmoidPrime(lastOutput)
+	last := len(n.Activations) - 1
+	derivative := n.Topology.Activations[last].Derivative
+	outputGradients := n.Errors[last].Data
+	for i, head := range n.Topology.Heads {
+		outputGradients[i] = weight * head.Gradient(lastOutput[i], evalTarget, wdlTarget) * derivative(lastOutput[i])
+	}
 
 	// Use the output gradients (errors really) to measure the inner errors
-	n.FindErrors(outputGradient)
+	n.FindErrors(outputGradients)
 
 	// Now, find the necessary updates to the gradients
 	n.UpdateGradients(input)
 
-	return ValidationCost(lastOutput, evalTarget, wdlTarget)
+	return weight * n.Cost(lastOutput, evalTarget, wdlTarget)
+}
+
+// Cost sums the loss of all the outputs
+func (n *Network) Cost(outputs []float32, evalTarget, wdlTarget float32) float32 {
+	cost := float32(0)
+	for i, head := range n.Topology.Heads {
+		cost += head.Cost(outputs[i], evalTarget, wdlTarget)
+	}
+	return cost
 }
 
 func (n *Network) ApplyGradients() {
@@ -396,20 +870,7 @@ func (n *Network) ApplyGradients() {
 		n.BGradients[i].Apply(&n.Biases[i])
 		n.WGradients[i].Apply(&n.Weights[i])
 	}
-}
-
-// Helper functions
-// randomly generate a float64 array
-func randomArray(size uint32, v float32) (data []float32) {
-	dist := distuv.Uniform{
-		Min: 0.0 / math.Sqrt(float64(v)),
-		Max: 2.0 / math.Sqrt(float64(v)),
+	if n.Topology.PSQT {
+		n.PSQTGradients.Apply(&n.PSQT)
 	}
-
-	data = make([]float32, size)
-	for i := uint32(0); i < size; i++ {
-		// data[i] = rand.NormFloat64() * math.Pow(v, -0.5)
-		data[i] = float32(dist.Rand())
-	}
-	return
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -26,6 +27,26 @@ func createNetwork() *Network {
 	return &net
 }
 
+func createPerspectiveNetwork() *Network {
+	top := NewTopology(8, 1, []uint32{4, 2})
+	top.Perspective = true
+	net := CreateNetwork(top, 30)
+
+	for i := 0; i < len(net.Activations); i++ {
+		bb := net.Biases[i]
+		for j := uint32(0); j < bb.Size(); j++ {
+			bb.Data[j] = 1
+		}
+
+		ww := net.Weights[i]
+		for j := uint32(0); j < ww.Size(); j++ {
+			ww.Data[j] = 1
+		}
+	}
+
+	return &net
+}
+
 func TestPredictPartialInput(t *testing.T) {
 	net := createNetwork()
 
@@ -66,11 +87,201 @@ func TestPredict(t *testing.T) {
 	}
 }
 
+func TestPredictPerspective(t *testing.T) {
+	net := createPerspectiveNetwork()
+
+	net.Predict([]int16{0, 2, 3, 1, 5, 6})
+
+	activations := [][]float32{
+		fill(8, 4),
+		fill(2, 33),
+		fill(1, Sigmoid(67)),
+	}
+
+	for i := 0; i < len(net.Activations); i++ {
+		expected := activations[i]
+		actual := net.Activations[i]
+		if !sameArray(expected, actual.Data) {
+			t.Errorf(fmt.Sprintf("Got %v, Expected %v", actual.Data, expected))
+		}
+	}
+}
+
+func TestUpdateGradientsPerspective(t *testing.T) {
+	net := createPerspectiveNetwork()
+
+	input := []int16{0, 2, 3, 1, 5, 6}
+	net.Predict(input)
+	net.FindErrors([]float32{0.5})
+	net.UpdateGradients(input)
+
+	// Both perspectives share the first layer, features 0, 2 and 3 are only
+	// active for the side to move and 1, 5 and 6 for the other side, and the
+	// errors of both halves are the same
+	wgrad := []float32{
+		1, 1, 1, 1,
+		1, 1, 1, 1,
+		1, 1, 1, 1,
+		1, 1, 1, 1,
+		0, 0, 0, 0,
+		1, 1, 1, 1,
+		1, 1, 1, 1,
+		0, 0, 0, 0,
+	}
+	if !sameArray(wgrad, net.WGradients[0].Values()) {
+		t.Errorf(fmt.Sprintf("Got %v, Expected %v", net.WGradients[0].Values(), wgrad))
+	}
+
+	bgrad := fill(4, 2)
+	if !sameArray(bgrad, net.BGradients[0].Values()) {
+		t.Errorf(fmt.Sprintf("Got %v, Expected %v", net.BGradients[0].Values(), bgrad))
+	}
+}
+
+func TestPredictClippedActivations(t *testing.T) {
+	net := createNetwork()
+	net.Topology.Activations = []Activation{SquaredClippedReLuActivation, ClippedReLuActivation, LinearActivation}
+	for j := range net.Weights[0].Data {
+		net.Weights[0].Data[j] = 0.1
+	}
+	for j := range net.Weights[1].Data {
+		net.Weights[1].Data[j] = 0.5
+	}
+	for l := 0; l < 2; l++ {
+		for j := range net.Biases[l].Data {
+			net.Biases[l].Data[j] = 0
+		}
+	}
+
+	output := net.Predict([]int16{0, 2, 3, 5, 6})
+
+	activations := [][]float32{
+		fill(4, 0.25),
+		fill(2, 0.5),
+		fill(1, 2),
+	}
+
+	for i := 0; i < len(net.Activations); i++ {
+		expected := activations[i]
+		actual := net.Activations[i]
+		if !sameApproxArray(expected, actual.Data) {
+			t.Errorf(fmt.Sprintf("Got %v, Expected %v", actual.Data, expected))
+		}
+	}
+
+	net.FindErrors(output)
+	errors := [][]float32{
+		fill(4, 2),
+		fill(2, 2),
+		fill(1, 2),
+	}
+	for i := 0; i < len(net.Activations); i++ {
+		expected := errors[i]
+		actual := net.Errors[i]
+		if !sameApproxArray(expected, actual.Data) {
+			t.Errorf(fmt.Sprintf("Got %v, Expected %v", actual.Data, expected))
+		}
+	}
+}
+
+func TestOutputBuckets(t *testing.T) {
+	top := NewTopology(769, 1, []uint32{4})
+	top.OutputBuckets = 4
+	net := CreateNetwork(top, 30)
+	for i := range net.Weights[1].Data {
+		net.Weights[1].Data[i] = float32(i % 4)
+		net.Biases[1].Data[i%4] = 0
+	}
+	for i := range net.Weights[0].Data {
+		net.Weights[0].Data[i] = 0.25
+		net.Biases[0].Data[i%4] = 0
+	}
+
+	// Three pieces and white to move, that is the first bucket. And 32
+	// pieces is the last bucket
+	inputs := [][]int16{{4, 5, 6, 768}, make([]int16, 32)}
+	pieces := []float32{3, 32}
+	buckets := []uint32{0, 3}
+	for i, input := range inputs {
+		output := net.Predict(input)[0]
+		expected := Sigmoid(4 * pieces[i] * 0.25 * float32(buckets[i]))
+		if output != expected {
+			t.Errorf("Got %f, Expected %f", output, expected)
+		}
+
+		net.FindErrors([]float32{0.5})
+		net.UpdateGradients(input)
+		for row := uint32(0); row < 4; row++ {
+			gradient := net.BGradients[1].Data[row].Value
+			if row == buckets[i] && gradient != 0.5 {
+				t.Errorf("Selected bucket %d has gradient %f, expected 0.5", row, gradient)
+			} else if row != buckets[i] && gradient != 0 {
+				t.Errorf("Bucket %d was not selected, but has gradient %f", row, gradient)
+			}
+			net.BGradients[1].Data[row].Reset()
+		}
+	}
+}
+
+func TestMultipleOutputs(t *testing.T) {
+	top := NewTopology(8, 2, []uint32{4})
+	top.Heads = []OutputHead{{Target: EvalTarget}, {Target: WDLTarget, Loss: CrossEntropy}}
+	net := CreateNetwork(top, 30)
+
+	input := []int16{0, 2, 3, 5, 6}
+	output := append([]float32{}, net.Predict(input)...)
+	if len(output) != 2 {
+		t.Errorf("Expected two outputs, got %v", output)
+	}
+
+	cost := net.Train(input, 0.75, 1)
+
+	evalGradient := 2 * (output[0] - 0.75) * SigmoidPrime(output[0])
+	wdlGradient := (output[1] - 1) * SigmoidScale
+	expected := []float32{evalGradient, wdlGradient}
+	if !sameApproxArray(expected, net.Errors[1].Data) {
+		t.Errorf(fmt.Sprintf("Got %v, Expected %v", net.Errors[1].Data, expected))
+	}
+
+	expectedCost := (output[0]-0.75)*(output[0]-0.75) - float32(math.Log(float64(output[1])))
+	if math.Abs(float64(cost-expectedCost)) > 1e-5 {
+		t.Errorf("Got cost %f, Expected %f", cost, expectedCost)
+	}
+}
+
+func TestPSQT(t *testing.T) {
+	top := NewTopology(8, 1, []uint32{4, 2})
+	top.Perspective = true
+	top.PSQT = true
+	net := CreateNetwork(top, 30)
+	for i := range net.PSQT.Data {
+		net.PSQT.Data[i] = float32(i)
+	}
+
+	input := []int16{0, 2, 3, 1, 5, 6}
+	withoutSkip := createPerspectiveNetwork()
+	expected := Sigmoid(67 + (0+2+3-1-5-6)/2.0)
+
+	// Only the skip connection differs from the perspective network
+	net.Weights, net.Biases = withoutSkip.Weights, withoutSkip.Biases
+	output := net.Predict(input)[0]
+	if output != expected {
+		t.Errorf("Got %f, Expected %f", output, expected)
+	}
+
+	net.FindErrors([]float32{0.5})
+	net.UpdateGradients(input)
+	expectedGradients := []float32{0.25, -0.25, 0.25, 0.25, 0, -0.25, -0.25, 0}
+	if !sameArray(expectedGradients, net.PSQTGradients.Values()) {
+		t.Errorf(fmt.Sprintf("Got %v, Expected %v", net.PSQTGradients.Values(), expectedGradients))
+	}
+}
+
 func TestFindErrors(t *testing.T) {
 	net := createNetwork()
 
 	net.Predict([]int16{0, 1, 2, 3, 4, 5, 6, 7})
-	net.FindErrors(0.5)
+	net.FindErrors([]float32{0.5})
 
 	errors := [][]float32{
 		fill(4, 1),
@@ -91,7 +302,7 @@ func TestFindErrorsPartialInput(t *testing.T) {
 	net := createNetwork()
 
 	net.Predict([]int16{0, 2, 3, 5, 6})
-	net.FindErrors(0.5)
+	net.FindErrors([]float32{0.5})
 
 	errors := [][]float32{
 		fill(4, ReLuPrime(6)),
@@ -113,7 +324,7 @@ func TestUpdateGradients(t *testing.T) {
 
 	input := []int16{0, 1, 2, 3, 4, 5, 6, 7}
 	net.Predict(input)
-	net.FindErrors(0.5)
+	net.FindErrors([]float32{0.5})
 	net.UpdateGradients(input)
 
 	wgrads := [][]float32{
@@ -149,7 +360,7 @@ func TestGradientUpdatePartialInput(t *testing.T) {
 
 	input := []int16{0, 2, 3, 5, 6}
 	net.Predict(input)
-	net.FindErrors(0.5)
+	net.FindErrors([]float32{0.5})
 	net.UpdateGradients(input)
 
 	wgrads := [][]float32{
@@ -193,7 +404,7 @@ func TestApplyGradients(t *testing.T) {
 
 	input := []int16{0, 1, 2, 3, 4, 5, 6, 7}
 	net.Predict(input)
-	net.FindErrors(0.5)
+	net.FindErrors([]float32{0.5})
 	net.UpdateGradients(input)
 
 	wgrads := [][]float32{
@@ -267,7 +478,7 @@ func TestApplyGradientsPartialInput(t *testing.T) {
 
 	input := []int16{0, 2, 3, 5, 6}
 	net.Predict(input)
-	net.FindErrors(0.5)
+	net.FindErrors([]float32{0.5})
 	net.UpdateGradients(input)
 
 	wgrads := [][]float32{
@@ -353,7 +564,7 @@ func TestGradientsDifferences(t *testing.T) {
 
 		net.Train(data.Input, Sigmoid(float32(data.Score)), float32(data.Outcome)/2)
 
-		lastOutput := net.Predict(data.Input)
+		lastOutput := net.Predict(data.Input)[0]
 		e1 := ValidationCost(lastOutput, Sigmoid(float32(data.Score)), float32(data.Outcome)/2)
 
 		change := float32(0.001)
@@ -362,7 +573,7 @@ func TestGradientsDifferences(t *testing.T) {
 		// Tweak a weight
 		net.Weights[2].Data[changeIndex] += change
 
-		lastOutput = net.Predict(data.Input)
+		lastOutput = net.Predict(data.Input)[0]
 		e2 := ValidationCost(lastOutput, Sigmoid(float32(data.Score)), float32(data.Outcome)/2)
 
 		grad := (e2 - e1) / change
@@ -380,6 +591,45 @@ func TestGradientsDifferences(t *testing.T) {
 	}
 }
 
+func TestInitializers(t *testing.T) {
+	defer func(initializer Initializer, distribution Distribution, zeroBiases bool) {
+		WeightInitializer, WeightDistribution, ZeroBiases = initializer, distribution, zeroBiases
+	}(WeightInitializer, WeightDistribution, ZeroBiases)
+
+	WeightInitializer = HeInitializer
+	WeightDistribution = UniformDistribution
+	ZeroBiases = true
+	top := NewTopology(768, 1, []uint32{32, 8})
+
+	SeedRandom(42)
+	net1 := CreateNetwork(top, 30)
+	SeedRandom(42)
+	net2 := CreateNetwork(top, 30)
+
+	fanIns := []float64{768, 32, 8}
+	for i := 0; i < len(net1.Activations); i++ {
+		if !sameArray(net1.Weights[i].Data, net2.Weights[i].Data) {
+			t.Errorf("Seeded networks have different weights in layer %d", i)
+		}
+
+		limit := math.Sqrt(6 / fanIns[i])
+		negative := false
+		for _, w := range net1.Weights[i].Data {
+			if math.Abs(float64(w)) > limit {
+				t.Errorf("Weight %f of layer %d is out of [-%f, %f]", w, i, limit, limit)
+			}
+			negative = negative || w < 0
+		}
+		if !negative {
+			t.Errorf("Weights of layer %d are all positive", i)
+		}
+
+		if !sameArray(fill(len(net1.Biases[i].Data), 0), net1.Biases[i].Data) {
+			t.Errorf("Biases of layer %d are not zero", i)
+		}
+	}
+}
+
 func TestBinaryReaderWriter(t *testing.T) {
 	top := NewTopology(10, 11, []uint32{12, 13, 14, 15, 16})
 	net1 := CreateNetwork(top, 30)
@@ -422,6 +672,42 @@ func TestBinaryReaderWriter(t *testing.T) {
 	}
 }
 
+func TestBinaryReaderWriterPerspective(t *testing.T) {
+	top := NewTopology(1280, 1, []uint32{12, 13})
+	top.Perspective = true
+	top.Features = HalfKPFeatures
+	top.KingBuckets = 2
+	top.MirrorKings = true
+	top.Activations = []Activation{SquaredClippedReLuActivation, ClippedReLuActivation, LinearActivation}
+	top.OutputBuckets = 8
+	top.Heads = []OutputHead{{Target: WDLTarget, Loss: CrossEntropy}}
+	top.PSQT = true
+	net1 := CreateNetwork(top, 30)
+	for i := range net1.PSQT.Data {
+		net1.PSQT.Data[i] = rand.Float32()
+	}
+
+	net1.Save("/tmp/net-perspective.nnue")
+	net2 := Load("/tmp/net-perspective.nnue")
+
+	if !sameTopology(net1.Topology, net2.Topology) {
+		t.Errorf("Topology was read incorrectly")
+	}
+
+	if !sameArray(net1.PSQT.Data, net2.PSQT.Data) {
+		t.Errorf("PSQT weights were read incorrectly")
+	}
+
+	for i := 0; i < len(net1.Activations); i++ {
+		if !sameArray(net1.Weights[i].Data, net2.Weights[i].Data) {
+			t.Errorf("Weights of layer %d were read incorrectly", i)
+		}
+		if !sameArray(net1.Biases[i].Data, net2.Biases[i].Data) {
+			t.Errorf("Biases of layer %d were read incorrectly", i)
+		}
+	}
+}
+
 func sameTopology(top1, top2 Topology) bool {
 	if top1.Inputs != top2.Inputs {
 		return false
@@ -431,6 +717,42 @@ func sameTopology(top1, top2 Topology) bool {
 		return false
 	}
 
+	if top1.Perspective != top2.Perspective {
+		return false
+	}
+
+	if top1.PSQT != top2.PSQT {
+		return false
+	}
+
+	if top1.OutputBuckets != top2.OutputBuckets {
+		return false
+	}
+
+	if len(top1.Heads) != len(top2.Heads) {
+		return false
+	}
+
+	for i := 0; i < len(top1.Heads); i++ {
+		if top1.Heads[i] != top2.Heads[i] {
+			return false
+		}
+	}
+
+	if top1.Features != top2.Features || top1.KingBuckets != top2.KingBuckets || top1.MirrorKings != top2.MirrorKings {
+		return false
+	}
+
+	if len(top1.Activations) != len(top2.Activations) {
+		return false
+	}
+
+	for i := 0; i < len(top1.Activations); i++ {
+		if top1.Activations[i] != top2.Activations[i] {
+			return false
+		}
+	}
+
 	if len(top1.HiddenNeurons) != len(top2.HiddenNeurons) {
 		return false
 	}
@@ -455,6 +777,18 @@ func sameArray(expected, actual []float32) bool {
 	return true
 }
 
+func sameApproxArray(expected, actual []float32) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := 0; i < len(expected); i++ {
+		if math.Abs(float64(expected[i]-actual[i])) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
 func fill(size int, with float32) []float32 {
 	a := make([]float32, size)
 	for i := 0; i < len(a); i++ {
@@ -462,3 +796,36 @@ func fill(size int, with float32) []float32 {
 	}
 	return a
 }
+
+func TestSaveFactorized(t *testing.T) {
+	top := NewTopology(0, 1, []uint32{8})
+	top.Features = HalfKPFeatures
+	top.Perspective = true
+	top.KingBuckets = 2
+	top.PSQT = true
+	top.Inputs = top.FeatureSet().Size()
+	net1 := CreateNetwork(top, 30)
+	net1.Factorize()
+	for i := range net1.Weights[0].Data {
+		net1.Weights[0].Data[i] = rand.Float32()
+	}
+	for i := range net1.PSQT.Data {
+		net1.PSQT.Data[i] = rand.Float32()
+	}
+
+	pos := ParseFen("r3k3/8/8/8/8/8/4P3/4K2R w - - 0 1")
+	factorized := net1.Topology.FeatureSet().Encode(&pos)
+	expected := net1.Predict(factorized)[0]
+
+	net1.Save("/tmp/net-factorized.nnue")
+	net2 := Load("/tmp/net-factorized.nnue")
+	if net2.Topology.Factorized || net2.Topology.Inputs != 1280 {
+		t.Errorf("Virtual features were stored")
+	}
+
+	real := net2.Topology.FeatureSet().Encode(&pos)
+	actual := net2.Predict(real)[0]
+	if math.Abs(float64(expected-actual)) > 1e-6 {
+		t.Errorf("Folded network predicts %f, expected %f", actual, expected)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -12,16 +13,28 @@ type (
 	Piece       uint8
 	Square      uint8
 	PositionTag uint8
+
+	// Position is a parsed FEN, it knows nothing about how the position is
+	// fed to the network
+	Position struct {
+		Board          [64]Piece
+		SideToMove     Color
+		Castling       PositionTag
+		EnPassant      Square
+		HalfMoveClock  uint16
+		FullMoveNumber uint16
+		// HasClocks is false when the FEN has no clocks, the clocks are the
+		// defaults then
+		HasClocks bool
+	}
 )
 
-// const (
-// 	WhiteToMove PositionTag = 1 << iota
-// 	BlackToMove
-// 	WhiteCanCastleKingSide
-// 	WhiteCanCastleQueenSide
-// 	BlackCanCastleKingSide
-// 	BlackCanCastleQueenSide
-// )
+const (
+	WhiteCanCastleKingSide PositionTag = 1 << iota
+	WhiteCanCastleQueenSide
+	BlackCanCastleKingSide
+	BlackCanCastleQueenSide
+)
 
 const (
 	A1 Square = iota
@@ -88,6 +101,7 @@ const (
 	F8
 	G8
 	H8
+	NoSquare
 )
 
 const (
@@ -152,55 +166,361 @@ func pieceFromName(name rune) Piece {
 
 var ranks = []Square{A8, A7, A6, A5, A4, A3, A2, A1}
 
+// FromFen encodes the FEN with the default (769 inputs) feature set
 func FromFen(fen string) []int16 {
+	pos := ParseFen(fen)
+	return PieceSquare{}.Encode(&pos)
+}
 
-	length := 0
-	spacesCount := 0
-	for i := 0; i < len(fen); i++ {
-		ch := rune(fen[i])
-		if ch == ' ' {
-			if spacesCount >= 1 {
-				break
-			}
-			spacesCount += 1
-		}
+// ParseFen parses a FEN, the clocks are optional so that EPDs can be parsed
+// too
+func ParseFen(fen string) Position {
+	pos, err := TryParseFen(fen)
+	if err != nil {
+		panic(err)
+	}
+	return pos
+}
 
-		if ch == 'w' {
-			length++
-		} else if spacesCount == 0 && ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') {
-			length++
-		}
+// TryParseFen is ParseFen that returns an error instead of panicking
+func TryParseFen(fen string) (Position, error) {
+	pos := emptyPosition()
+
+	fields := strings.Fields(fen)
+	if len(fields) < 2 {
+		return pos, fmt.Errorf("Invalid FEN notation %s, expected at least the board and the side to move", fen)
 	}
-	input := make([]int16, length)
 
 	rank := 0
 	boardIndex := A8
-	pieceCounts := 0
-	finalIndex := 0
-	for i := 0; i < len(fen); i++ {
-		ch := rune(fen[i])
-		if ch == ' ' || rank >= len(ranks) {
-			finalIndex = i
-			break // end of the board
-		} else if unicode.IsDigit(ch) {
+	for _, ch := range fields[0] {
+		if unicode.IsDigit(ch) {
 			n, _ := strconv.Atoi(string(ch))
 			boardIndex += Square(n)
-		} else if ch == '/' && boardIndex%8 == 0 {
+		} else if ch == '/' && boardIndex%8 == 0 && rank+1 < len(ranks) {
 			rank++
 			boardIndex = ranks[rank]
-			continue
-		} else if p := pieceFromName(ch); p != NoPiece {
-			input[pieceCounts] = int16(p)*64 + int16(boardIndex)
-			pieceCounts++
+		} else if p := pieceFromName(ch); p != NoPiece && boardIndex <= H8 {
+			pos.Board[boardIndex] = p
 			boardIndex++
 		} else {
-			panic(fmt.Sprintf("Invalid FEN notation %s, boardIndex == %d, parsing %s\n",
-				fen, boardIndex, string(ch)))
+			return pos, fmt.Errorf("Invalid FEN notation %s, boardIndex == %d, parsing %s",
+				fen, boardIndex, string(ch))
+		}
+	}
+
+	switch fields[1] {
+	case "w":
+		pos.SideToMove = White
+	case "b":
+		pos.SideToMove = Black
+	default:
+		return pos, fmt.Errorf("Invalid FEN notation %s, unknown side to move %s", fen, fields[1])
+	}
+
+	if len(fields) > 2 && fields[2] != "-" {
+		for _, ch := range fields[2] {
+			switch ch {
+			case 'K':
+				pos.Castling |= WhiteCanCastleKingSide
+			case 'Q':
+				pos.Castling |= WhiteCanCastleQueenSide
+			case 'k':
+				pos.Castling |= BlackCanCastleKingSide
+			case 'q':
+				pos.Castling |= BlackCanCastleQueenSide
+			default:
+				return pos, fmt.Errorf("Invalid FEN notation %s, unknown castling right %s", fen, string(ch))
+			}
+		}
+	}
+
+	if len(fields) > 3 && fields[3] != "-" {
+		sq := fields[3]
+		if len(sq) != 2 || sq[0] < 'a' || sq[0] > 'h' || sq[1] < '1' || sq[1] > '8' {
+			return pos, fmt.Errorf("Invalid FEN notation %s, bad en passant square %s", fen, sq)
+		}
+		pos.EnPassant = Square((sq[1]-'1')*8 + sq[0] - 'a')
+	}
+
+	if len(fields) > 5 {
+		halfMoves, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return pos, fmt.Errorf("Invalid FEN notation %s, %s", fen, err)
+		}
+		fullMoves, err := strconv.Atoi(fields[5])
+		if err != nil {
+			return pos, fmt.Errorf("Invalid FEN notation %s, %s", fen, err)
+		}
+		pos.HalfMoveClock = uint16(halfMoves)
+		pos.FullMoveNumber = uint16(fullMoves)
+		pos.HasClocks = true
+	}
+
+	return pos, nil
+}
+
+// PieceCount returns the number of pieces on the board, kings included
+func (pos *Position) PieceCount() int {
+	count := 0
+	for _, p := range pos.Board {
+		if p != NoPiece {
+			count++
+		}
+	}
+	return count
+}
+
+// King returns the square of the king of the given color, or NoSquare when
+// there is no such king
+func (pos *Position) King(color Color) Square {
+	king := WhiteKing
+	if color == Black {
+		king = BlackKing
+	}
+	for sq, p := range pos.Board {
+		if p == king {
+			return Square(sq)
+		}
+	}
+	return NoSquare
+}
+
+// Flip returns the same piece type with the opposite color
+func (p Piece) Flip() Piece {
+	if p == NoPiece {
+		return p
+	}
+	return (p + 6) % 12
+}
+
+// Flip returns the square mirrored vertically, i.e. A1 becomes A8
+func (sq Square) Flip() Square {
+	return sq ^ 56
+}
+
+// Move is a move in UCI notation, Promotion is Pawn when the move is not a
+// promotion
+type Move struct {
+	From      Square
+	To        Square
+	Promotion PieceType
+}
+
+// ParseMove parses a move in UCI notation, i.e. e2e4 or e7e8q
+func ParseMove(move string) Move {
+	square := func(sq string) Square {
+		if sq[0] < 'a' || sq[0] > 'h' || sq[1] < '1' || sq[1] > '8' {
+			panic(fmt.Sprintf("Invalid move %s, bad square %s\n", move, sq))
+		}
+		return Square((sq[1]-'1')*8 + sq[0] - 'a')
+	}
+
+	if len(move) != 4 && len(move) != 5 {
+		panic(fmt.Sprintf("Invalid move %s\n", move))
+	}
+	m := Move{From: square(move[:2]), To: square(move[2:4]), Promotion: Pawn}
+	if len(move) == 5 {
+		switch move[4] {
+		case 'n':
+			m.Promotion = Knight
+		case 'b':
+			m.Promotion = Bishop
+		case 'r':
+			m.Promotion = Rook
+		case 'q':
+			m.Promotion = Queen
+		default:
+			panic(fmt.Sprintf("Invalid move %s, bad promotion %s\n", move, move[4:]))
+		}
+	}
+	return m
+}
+
+// Play returns the position after the move, the move is not checked for
+// legality but captures, castling, en passant and promotions are handled
+func (pos *Position) Play(m Move) Position {
+	next := *pos
+	piece := pos.Board[m.From]
+	if piece == NoPiece {
+		panic(fmt.Sprintf("Invalid move, there is no piece on square %d\n", m.From))
+	}
+	pieceType := PieceType(piece % 6)
+	captured := pos.Board[m.To]
+
+	next.Board[m.From] = NoPiece
+	next.Board[m.To] = piece
+	next.EnPassant = NoSquare
+	switch {
+	case pieceType == Pawn && m.To == pos.EnPassant && m.From%8 != m.To%8:
+		// The captured pawn is behind the target square
+		next.Board[m.To^8] = NoPiece
+		captured = pos.Board[m.To^8]
+	case pieceType == Pawn && (m.To == m.From+16 || m.From == m.To+16):
+		next.EnPassant = (m.From + m.To) / 2
+	case pieceType == King && m.To == m.From+2:
+		next.Board[m.From+1], next.Board[m.From+3] = next.Board[m.From+3], NoPiece
+	case pieceType == King && m.From == m.To+2:
+		next.Board[m.From-1], next.Board[m.From-4] = next.Board[m.From-4], NoPiece
+	}
+	if m.Promotion != Pawn {
+		next.Board[m.To] = Piece(m.Promotion) + piece - Piece(pieceType)
+	}
+
+	// Moving the king or a rook, or capturing a rook, drops the castling
+	// rights that depend on them
+	rights := map[Square]PositionTag{
+		E1: WhiteCanCastleKingSide | WhiteCanCastleQueenSide,
+		H1: WhiteCanCastleKingSide,
+		A1: WhiteCanCastleQueenSide,
+		E8: BlackCanCastleKingSide | BlackCanCastleQueenSide,
+		H8: BlackCanCastleKingSide,
+		A8: BlackCanCastleQueenSide,
+	}
+	next.Castling &^= rights[m.From] | rights[m.To]
+
+	next.HalfMoveClock++
+	if pieceType == Pawn || captured != NoPiece {
+		next.HalfMoveClock = 0
+	}
+	if pos.SideToMove == Black {
+		next.FullMoveNumber++
+	}
+	next.SideToMove = 1 - pos.SideToMove
+	return next
+}
+
+// emptyPosition returns a position without pieces, white to move
+func emptyPosition() Position {
+	pos := Position{
+		EnPassant:      NoSquare,
+		FullMoveNumber: 1,
+	}
+	for i := range pos.Board {
+		pos.Board[i] = NoPiece
+	}
+	return pos
+}
+
+// possibleCastling returns the castling rights that the board allows, that is
+// the rights of the kings and rooks that are still on their initial squares
+func (pos *Position) possibleCastling() PositionTag {
+	rights := PositionTag(0)
+	if pos.Board[E1] == WhiteKing {
+		if pos.Board[H1] == WhiteRook {
+			rights |= WhiteCanCastleKingSide
+		}
+		if pos.Board[A1] == WhiteRook {
+			rights |= WhiteCanCastleQueenSide
+		}
+	}
+	if pos.Board[E8] == BlackKing {
+		if pos.Board[H8] == BlackRook {
+			rights |= BlackCanCastleKingSide
+		}
+		if pos.Board[A8] == BlackRook {
+			rights |= BlackCanCastleQueenSide
+		}
+	}
+	return rights
+}
+
+// FlipColors returns the position with the colors swapped and the board
+// flipped vertically, the side to move is swapped too so the position is
+// just as good for the side to move
+func (pos *Position) FlipColors() Position {
+	flipped := *pos
+	for sq, p := range pos.Board {
+		flipped.Board[Square(sq).Flip()] = p.Flip()
+	}
+	flipped.SideToMove = 1 - pos.SideToMove
+	flipped.Castling = (pos.Castling&(WhiteCanCastleKingSide|WhiteCanCastleQueenSide))<<2 |
+		(pos.Castling&(BlackCanCastleKingSide|BlackCanCastleQueenSide))>>2
+	if pos.EnPassant != NoSquare {
+		flipped.EnPassant = pos.EnPassant.Flip()
+	}
+	return flipped
+}
+
+// Mirror returns the position mirrored horizontally, i.e. A1 becomes H1.
+// Castling is not symmetric, so positions with castling rights can not be
+// mirrored
+func (pos *Position) Mirror() Position {
+	if pos.Castling != 0 {
+		panic("Position with castling rights can not be mirrored")
+	}
+	mirrored := *pos
+	for sq, p := range pos.Board {
+		mirrored.Board[sq^7] = p
+	}
+	if pos.EnPassant != NoSquare {
+		mirrored.EnPassant = pos.EnPassant ^ 7
+	}
+	return mirrored
+}
+
+var (
+	knightOffsets = [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}}
+	kingOffsets   = [][2]int{{0, 1}, {1, 1}, {1, 0}, {1, -1}, {0, -1}, {-1, -1}, {-1, 0}, {-1, 1}}
+)
+
+// InCheck reports whether the king of the side to move is attacked
+func (pos *Position) InCheck() bool {
+	king := pos.King(pos.SideToMove)
+	return king != NoSquare && pos.Attacked(king, 1-pos.SideToMove)
+}
+
+// Attacked reports whether any piece of the given color attacks the square
+func (pos *Position) Attacked(sq Square, by Color) bool {
+	piece := func(pieceType PieceType) Piece {
+		return Piece(pieceType) + Piece(by)*6
+	}
+	file, rank := int(sq%8), int(sq/8)
+	at := func(df, dr int) Piece {
+		f, r := file+df, rank+dr
+		if f < 0 || f > 7 || r < 0 || r > 7 {
+			return NoPiece
 		}
+		return pos.Board[r*8+f]
 	}
-	if fen[finalIndex+1] == 'w' {
-		input[len(input)-1] = 768
+
+	// Pawns attack diagonally forward, so they are behind the square
+	direction := -1
+	if by == Black {
+		direction = 1
+	}
+	if at(-1, direction) == piece(Pawn) || at(1, direction) == piece(Pawn) {
+		return true
+	}
+	for _, offset := range knightOffsets {
+		if at(offset[0], offset[1]) == piece(Knight) {
+			return true
+		}
+	}
+	for _, offset := range kingOffsets {
+		if at(offset[0], offset[1]) == piece(King) {
+			return true
+		}
 	}
 
-	return input
+	// Sliders attack along the rays until the first piece, rooks on the
+	// straight rays and bishops on the diagonal ones
+	for _, offset := range kingOffsets {
+		slider := piece(Rook)
+		if offset[0] != 0 && offset[1] != 0 {
+			slider = piece(Bishop)
+		}
+		for distance := 1; distance < 8; distance++ {
+			f, r := file+distance*offset[0], rank+distance*offset[1]
+			if f < 0 || f > 7 || r < 0 || r > 7 {
+				break
+			}
+			if p := pos.Board[r*8+f]; p == slider || p == piece(Queen) {
+				return true
+			} else if p != NoPiece {
+				break
+			}
+		}
+	}
+	return false
 }
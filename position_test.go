@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFen(t *testing.T) {
+	pos := ParseFen("r3k2r/8/8/3pP3/8/8/8/R3K2R w Kq d6 3 42")
+
+	if pos.Board[A1] != WhiteRook || pos.Board[E8] != BlackKing || pos.Board[D5] != BlackPawn {
+		t.Errorf("Board is parsed wrong, got %v", pos.Board)
+	}
+	if pos.SideToMove != White {
+		t.Errorf("Side to move is parsed wrong, got %d", pos.SideToMove)
+	}
+	if pos.Castling != WhiteCanCastleKingSide|BlackCanCastleQueenSide {
+		t.Errorf("Castling rights are parsed wrong, got %d", pos.Castling)
+	}
+	if pos.EnPassant != D6 {
+		t.Errorf("En passant square is parsed wrong, expected %d, got %d", D6, pos.EnPassant)
+	}
+	if pos.HalfMoveClock != 3 || pos.FullMoveNumber != 42 || !pos.HasClocks {
+		t.Errorf("Clocks are parsed wrong, got %d and %d", pos.HalfMoveClock, pos.FullMoveNumber)
+	}
+	if pos := ParseFen("r3k2r/8/8/3pP3/8/8/8/R3K2R w Kq d6"); pos.HasClocks {
+		t.Errorf("Expected the clocks to be unknown without the clock fields")
+	}
+}
+
+func TestPlay(t *testing.T) {
+	pos := ParseFen("r3k2r/6P1/8/3pP3/8/8/8/R3K2R w KQkq d6 3 42")
+
+	next := pos.Play(ParseMove("e5d6"))
+	if next.Board[D6] != WhitePawn || next.Board[D5] != NoPiece || next.Board[E5] != NoPiece {
+		t.Errorf("En passant is played wrong, got %v", next.Board)
+	}
+	if next.SideToMove != Black || next.HalfMoveClock != 0 || next.EnPassant != NoSquare {
+		t.Errorf("State after en passant is wrong, got %v", next)
+	}
+
+	next = pos.Play(ParseMove("e1g1"))
+	if next.Board[G1] != WhiteKing || next.Board[F1] != WhiteRook || next.Board[H1] != NoPiece {
+		t.Errorf("Castling is played wrong, got %v", next.Board)
+	}
+	if next.Castling != BlackCanCastleKingSide|BlackCanCastleQueenSide {
+		t.Errorf("Castling rights after castling are wrong, got %d", next.Castling)
+	}
+
+	next = pos.Play(ParseMove("g7h8n"))
+	if next.Board[H8] != WhiteKnight || next.Board[G7] != NoPiece {
+		t.Errorf("Promotion is played wrong, got %v", next.Board)
+	}
+	if next.Castling != WhiteCanCastleKingSide|WhiteCanCastleQueenSide|BlackCanCastleQueenSide {
+		t.Errorf("Capturing a rook should drop its castling right, got %d", next.Castling)
+	}
+
+	next = next.Play(ParseMove("e8c8"))
+	if next.Board[C8] != BlackKing || next.Board[D8] != BlackRook || next.Board[A8] != NoPiece {
+		t.Errorf("Queen side castling is played wrong, got %v", next.Board)
+	}
+	if next.FullMoveNumber != 43 {
+		t.Errorf("Full move number is not incremented, got %d", next.FullMoveNumber)
+	}
+}
+
+func TestFlipColorsAndMirror(t *testing.T) {
+	pos := ParseFen("r3k3/8/8/3pP3/8/8/8/4K2R w Kq d6 0 1")
+
+	flipped := pos.FlipColors()
+	if flipped.Board[E1] != WhiteKing || flipped.Board[A1] != WhiteRook || flipped.Board[H8] != BlackRook || flipped.Board[D4] != WhitePawn {
+		t.Errorf("Colors are flipped wrong, got %v", flipped.Board)
+	}
+	if flipped.SideToMove != Black || flipped.Castling != WhiteCanCastleQueenSide|BlackCanCastleKingSide || flipped.EnPassant != D3 {
+		t.Errorf("State is flipped wrong, got %v", flipped)
+	}
+
+	pos = ParseFen("8/8/8/3pP3/8/8/1k6/4K3 w - d6 0 1")
+	mirrored := pos.Mirror()
+	if mirrored.Board[D1] != WhiteKing || mirrored.Board[G2] != BlackKing || mirrored.Board[E5] != BlackPawn || mirrored.EnPassant != E6 {
+		t.Errorf("Position is mirrored wrong, got %v", mirrored)
+	}
+}
+
+func TestInCheck(t *testing.T) {
+	fens := map[string]bool{
+		"4k3/8/8/8/8/8/8/4K2R w - - 0 1":    false,
+		"4k3/8/8/8/8/8/8/4K2R b - - 0 1":    false,
+		"4k3/8/8/8/1b6/8/8/4K3 w - - 0 1":   true,
+		"4k3/8/8/8/1b6/2P5/8/4K3 w - - 0 1": false,
+		"4k3/8/8/8/8/8/3p4/4K3 w - - 0 1":   true,
+		"4k3/8/8/8/8/3n4/8/4K3 w - - 0 1":   true,
+		"4k3/4q3/8/8/8/8/8/4K3 w - - 0 1":   true,
+		"4k3/3P4/8/8/8/8/8/4K3 b - - 0 1":   true,
+		"4k3/4P3/8/8/8/8/8/4K3 b - - 0 1":   false,
+	}
+	for fen, check := range fens {
+		pos := ParseFen(fen)
+		if pos.InCheck() != check {
+			t.Errorf("%s: expected in check to be %v", fen, check)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DatasetStats summarizes the samples of a dataset
+type DatasetStats struct {
+	Samples int64
+	// Outcomes counts the losses, draws and wins of the side to move
+	Outcomes [3]int64
+	// ScoreHistogram counts the scores in buckets of ScoreBucketWidth, from
+	// -MaxHistogramScore to MaxHistogramScore, the first and last buckets
+	// count the scores below and above that range
+	ScoreHistogram []int64
+	// Pieces counts the positions by their number of pieces, kings included
+	Pieces []int64
+	// SideToMove counts the positions where white and black are to move,
+	// it is known for the samples with a position, and for the samples of
+	// the feature sets that encode it
+	SideToMove        [2]int64
+	UnknownSideToMove int64
+	// FeatureUsage counts the samples where each input is active, an input
+	// that is active in both perspectives of a sample is counted once
+	FeatureUsage []int64
+	// BadSamples counts the samples with an outcome or an input out of
+	// range, they are not part of the other statistics
+	BadSamples int64
+
+	// counted is the last sample that counted each input
+	counted []int64
+
+	scoreSum, scoreSquares     float64
+	outcomeSum, outcomeSquares float64
+	scoreOutcomeSum            float64
+}
+
+const (
+	ScoreBucketWidth  = 100
+	MaxHistogramScore = 1000
+)
+
+func NewDatasetStats() *DatasetStats {
+	return &DatasetStats{
+		ScoreHistogram: make([]int64, 2*MaxHistogramScore/ScoreBucketWidth+2),
+		Pieces:         make([]int64, 33),
+		FeatureUsage:   make([]int64, Features.Size()),
+		counted:        make([]int64, Features.Size()),
+	}
+}
+
+// CollectStats reads all the samples of the text and binpack files, the
+// filters apply as usual
+func CollectStats(paths []string) *DatasetStats {
+	stats := NewDatasetStats()
+	reader := openSamples(paths)
+	defer reader.Close()
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		stats.Add(sample, reader.Position())
+		if stats.Samples%1_000_000 == 0 {
+			fmt.Printf("%d samples are read\r", stats.Samples)
+		}
+	}
+	printSkipped(reader.Skipped())
+	printFiltered()
+	return stats
+}
+
+// Add counts the sample, pos is nil for the samples of binpacks of features
+func (s *DatasetStats) Add(sample Data, pos *Position) {
+	if sample.Outcome < 0 || int(sample.Outcome) >= len(s.Outcomes) {
+		s.BadSamples++
+		return
+	}
+	for _, feature := range sample.Input {
+		if feature < 0 || int(feature) >= len(s.FeatureUsage) {
+			s.BadSamples++
+			return
+		}
+	}
+
+	s.Samples++
+	s.Outcomes[sample.Outcome]++
+
+	bucket := 0
+	if sample.Score >= MaxHistogramScore {
+		bucket = len(s.ScoreHistogram) - 1
+	} else if sample.Score >= -MaxHistogramScore {
+		bucket = 1 + (int(sample.Score)+MaxHistogramScore)/ScoreBucketWidth
+	}
+	s.ScoreHistogram[bucket]++
+
+	var pieces int
+	if pos != nil {
+		pieces = pos.PieceCount()
+	} else {
+		pieces = Features.Pieces(sample.Input)
+	}
+	if pieces >= len(s.Pieces) {
+		pieces = len(s.Pieces) - 1
+	}
+	s.Pieces[pieces]++
+
+	_, pieceSquare := Features.(PieceSquare)
+	if pos != nil {
+		s.SideToMove[pos.SideToMove]++
+	} else if pieceSquare {
+		if n := len(sample.Input); n > 0 && sample.Input[n-1] == 768 {
+			s.SideToMove[White]++
+		} else {
+			s.SideToMove[Black]++
+		}
+	} else {
+		s.UnknownSideToMove++
+	}
+
+	for _, feature := range sample.Input {
+		if s.counted[feature] != s.Samples {
+			s.counted[feature] = s.Samples
+			s.FeatureUsage[feature]++
+		}
+	}
+
+	score := float64(sample.Score)
+	outcome := float64(sample.Outcome) / 2
+	s.scoreSum += score
+	s.scoreSquares += score * score
+	s.outcomeSum += outcome
+	s.outcomeSquares += outcome * outcome
+	s.scoreOutcomeSum += score * outcome
+}
+
+func (s *DatasetStats) ScoreMean() float64 {
+	return s.scoreSum / float64(s.Samples)
+}
+
+func (s *DatasetStats) ScoreStddev() float64 {
+	mean := s.ScoreMean()
+	return math.Sqrt(math.Max(s.scoreSquares/float64(s.Samples)-mean*mean, 0))
+}
+
+// Correlation is the Pearson correlation between the scores and the outcomes
+func (s *DatasetStats) Correlation() float64 {
+	n := float64(s.Samples)
+	covariance := s.scoreOutcomeSum/n - s.scoreSum/n*s.outcomeSum/n
+	outcomeMean := s.outcomeSum / n
+	outcomeStddev := math.Sqrt(math.Max(s.outcomeSquares/n-outcomeMean*outcomeMean, 0))
+	if outcomeStddev == 0 || s.ScoreStddev() == 0 {
+		return 0
+	}
+	return covariance / (s.ScoreStddev() * outcomeStddev)
+}
+
+func (s *DatasetStats) Print() {
+	fmt.Printf("Samples: %d\n", s.Samples)
+	if s.BadSamples != 0 {
+		fmt.Printf("Bad samples: %d, their outcome or inputs are out of range\n", s.BadSamples)
+	}
+	if s.Samples == 0 {
+		return
+	}
+	percent := func(count int64) float64 {
+		return 100 * float64(count) / float64(s.Samples)
+	}
+	bar := func(count int64, max int64) string {
+		return strings.Repeat("#", int(40*count/max))
+	}
+	maxOf := func(counts []int64) int64 {
+		max := int64(1)
+		for _, c := range counts {
+			if c > max {
+				max = c
+			}
+		}
+		return max
+	}
+
+	fmt.Println("\nOutcomes (side to move):")
+	for i, name := range []string{"loss", "draw", "win"} {
+		fmt.Printf("  %-5s %12d %6.2f%%\n", name, s.Outcomes[i], percent(s.Outcomes[i]))
+	}
+
+	fmt.Println("\nSide to move:")
+	fmt.Printf("  white   %12d %6.2f%%\n", s.SideToMove[White], percent(s.SideToMove[White]))
+	fmt.Printf("  black   %12d %6.2f%%\n", s.SideToMove[Black], percent(s.SideToMove[Black]))
+	if s.UnknownSideToMove != 0 {
+		fmt.Printf("  unknown %12d %6.2f%%, the %s feature set does not encode it\n",
+			s.UnknownSideToMove, percent(s.UnknownSideToMove), Features.Name())
+	}
+
+	fmt.Printf("\nScores: mean %.2f, stddev %.2f\n", s.ScoreMean(), s.ScoreStddev())
+	max := maxOf(s.ScoreHistogram)
+	for i, count := range s.ScoreHistogram {
+		var label string
+		switch i {
+		case 0:
+			label = fmt.Sprintf("< %d", -MaxHistogramScore)
+		case len(s.ScoreHistogram) - 1:
+			label = fmt.Sprintf(">= %d", MaxHistogramScore)
+		default:
+			from := -MaxHistogramScore + (i-1)*ScoreBucketWidth
+			label = fmt.Sprintf("[%d, %d)", from, from+ScoreBucketWidth)
+		}
+		fmt.Printf("  %-14s %12d %6.2f%% %s\n", label, count, percent(count), bar(count, max))
+	}
+
+	fmt.Println("\nPieces:")
+	max = maxOf(s.Pieces)
+	for pieces, count := range s.Pieces {
+		if count != 0 {
+			fmt.Printf("  %2d %12d %6.2f%% %s\n", pieces, count, percent(count), bar(count, max))
+		}
+	}
+
+	fmt.Printf("\nCorrelation between scores and outcomes: %.4f\n", s.Correlation())
+
+	used := make([]int, 0, len(s.FeatureUsage))
+	for i, count := range s.FeatureUsage {
+		if count != 0 {
+			used = append(used, i)
+		}
+	}
+	sort.SliceStable(used, func(i, j int) bool { return s.FeatureUsage[used[i]] > s.FeatureUsage[used[j]] })
+	fmt.Printf("\nInputs: %d of %d are used, the most used are:\n", len(used), len(s.FeatureUsage))
+	for _, i := range used[:min(len(used), 10)] {
+		fmt.Printf("  %6d %12d %6.2f%%\n", i, s.FeatureUsage[i], percent(s.FeatureUsage[i]))
+	}
+}
+
+// WriteFeatureUsage writes the usage count of every input, one per line
+func (s *DatasetStats) WriteFeatureUsage(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	for i, count := range s.FeatureUsage {
+		if _, err := fmt.Fprintf(writer, "%d,%d\n", i, count); err != nil {
+			panic(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
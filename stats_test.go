@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDatasetStats(t *testing.T) {
+	stats := NewDatasetStats()
+	samples := []string{
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:300;eval:0;qs:0;outcome:1.0",
+		"4k3/8/8/8/8/8/4P3/4K3 b - - 0 1;score:-250;eval:0;qs:0;outcome:0.0",
+		"4k3/8/8/8/8/8/8/4K3 w - - 0 1;score:0;eval:0;qs:0;outcome:0.5",
+		"4k3/8/8/8/8/8/8/4K3 b - - 0 1;score:1500;eval:0;qs:0;outcome:1.0",
+	}
+	for _, line := range samples {
+		stats.Add(ParseLine(line), nil)
+	}
+
+	if stats.Samples != 4 || stats.Outcomes != [3]int64{1, 1, 2} {
+		t.Errorf("Unexpected outcomes %v of %d samples", stats.Outcomes, stats.Samples)
+	}
+	if stats.SideToMove != [2]int64{2, 2} {
+		t.Errorf("Unexpected side to move balance %v", stats.SideToMove)
+	}
+	if stats.Pieces[2] != 2 || stats.Pieces[3] != 2 {
+		t.Errorf("Unexpected piece counts %v", stats.Pieces)
+	}
+	last := len(stats.ScoreHistogram) - 1
+	if stats.ScoreHistogram[last] != 1 || stats.ScoreHistogram[8] != 1 || stats.ScoreHistogram[11] != 1 || stats.ScoreHistogram[14] != 1 {
+		t.Errorf("Unexpected score histogram %v", stats.ScoreHistogram)
+	}
+	if stats.ScoreMean() != 387.5 {
+		t.Errorf("Expected a mean score of 387.5, got %f", stats.ScoreMean())
+	}
+	if math.Abs(stats.ScoreStddev()-671.17) > 0.01 {
+		t.Errorf("Expected a score stddev of 671.17, got %f", stats.ScoreStddev())
+	}
+	if c := stats.Correlation(); c < 0.5 || c > 1 {
+		t.Errorf("Expected a strong correlation, got %f", c)
+	}
+	if stats.FeatureUsage[768] != 2 || stats.FeatureUsage[int(WhitePawn)*64+int(E2)] != 2 {
+		t.Errorf("Unexpected feature usage")
+	}
+}
+
+func TestDatasetStatsPositions(t *testing.T) {
+	defer func(features FeatureSet) { Features = features }(Features)
+	Features = PerspectivePieceSquare{}
+
+	// The side to move is taken from the positions, the feature set does
+	// not encode it
+	stats := NewDatasetStats()
+	for _, fen := range []string{"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", "4k3/8/8/8/8/8/4P3/4K3 b - - 0 1"} {
+		pos := ParseFen(fen)
+		stats.Add(Data{Input: Features.Encode(&pos), Outcome: 1}, &pos)
+	}
+	stats.Add(Data{Input: []int16{1}, Outcome: 1}, nil)
+	if stats.SideToMove != [2]int64{1, 1} || stats.UnknownSideToMove != 1 {
+		t.Errorf("Unexpected side to move balance %v, %d unknown", stats.SideToMove, stats.UnknownSideToMove)
+	}
+
+	// The kings of both perspectives are the same input, it is counted once
+	// per sample
+	king := int16(WhiteKing)*64 + int16(E1)
+	if stats.FeatureUsage[king] != 2 {
+		t.Errorf("Expected the king input to be used by 2 samples, got %d", stats.FeatureUsage[king])
+	}
+
+	// Malformed samples are counted, not added
+	stats.Add(Data{Input: []int16{1}, Outcome: 3}, nil)
+	stats.Add(Data{Input: []int16{int16(Features.Size())}, Outcome: 1}, nil)
+	stats.Add(Data{Input: []int16{-1}, Outcome: 1}, nil)
+	if stats.Samples != 3 || stats.BadSamples != 3 {
+		t.Errorf("Expected 3 samples and 3 bad samples, got %d and %d", stats.Samples, stats.BadSamples)
+	}
+}
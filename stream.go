@@ -0,0 +1,203 @@
+package main
+
+import (
+	"math/rand"
+)
+
+type (
+	// Iterator walks over the samples of a dataset once
+	Iterator interface {
+		// Next fills the batch with the following samples and returns how
+		// many were filled, it is less than the size of the batch only at the
+		// end of the dataset
+		Next(batch []Data) int
+		Close()
+	}
+
+	// Source starts a new pass over a dataset, one for every epoch
+	Source interface {
+		Iterate() Iterator
+	}
+
+	// InMemory is a dataset that is fully loaded into memory
+	InMemory []Data
+
+	// Stream reads the dataset from disk on every pass, so that only the
+	// shuffle buffer is kept in memory. The shuffle buffer spreads apart the
+	// samples that are close in the files, which usually come from the same
+	// game
+	Stream struct {
+		Paths []string
+		// Skip is the number of samples at the start of the dataset that are
+		// ignored, they are kept for validation
+		Skip          int
+		ShuffleBuffer int
+	}
+
+	memoryIterator struct {
+		data []Data
+	}
+
+	streamIterator struct {
+		chunks chan []Data
+		done   chan struct{}
+		// finished is closed once the reader has stopped and closed its files
+		finished chan struct{}
+		chunk    []Data
+	}
+)
+
+// streamChunkSize is the number of samples that the reader of a stream hands
+// over to the trainer at once
+const streamChunkSize = 1024
+
+func (d InMemory) Iterate() Iterator {
+	return &memoryIterator{data: d}
+}
+
+func (it *memoryIterator) Next(batch []Data) int {
+	n := copy(batch, it.data)
+	it.data = it.data[n:]
+	return n
+}
+
+func (it *memoryIterator) Close() {}
+
+// Iterate starts reading the files in the background
+func (s *Stream) Iterate() Iterator {
+	it := &streamIterator{
+		chunks:   make(chan []Data, 16),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go s.read(it)
+	return it
+}
+
+// read passes the samples of the files through the shuffle buffer, every new
+// sample replaces a random sample of the buffer, which is sent to the trainer
+func (s *Stream) read(it *streamIterator) {
+	defer close(it.finished)
+	defer close(it.chunks)
+	reader := openSamples(s.Paths)
+	defer reader.Close()
+
+	chunk := make([]Data, 0, streamChunkSize)
+	send := func(sample Data) bool {
+		chunk = append(chunk, sample)
+		if len(chunk) < streamChunkSize {
+			return true
+		}
+		select {
+		case it.chunks <- chunk:
+			chunk = make([]Data, 0, streamChunkSize)
+			return true
+		case <-it.done:
+			return false
+		}
+	}
+
+	stopped := func() bool {
+		select {
+		case <-it.done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for i := 0; i < s.Skip; i++ {
+		if _, ok := reader.Read(); !ok || stopped() {
+			return
+		}
+	}
+
+	buffer := make([]Data, 0, s.ShuffleBuffer)
+	for {
+		if stopped() {
+			return
+		}
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		weighSample(&sample, reader.Position())
+		if len(buffer) < s.ShuffleBuffer {
+			buffer = append(buffer, sample)
+			continue
+		}
+		if len(buffer) == 0 {
+			// Without a shuffle buffer the samples are sent in order
+			if !send(sample) {
+				return
+			}
+			continue
+		}
+		j := rand.Intn(len(buffer))
+		if !send(buffer[j]) {
+			return
+		}
+		buffer[j] = sample
+	}
+
+	printSkipped(reader.Skipped())
+	printFiltered()
+	rand.Shuffle(len(buffer), func(i, j int) { buffer[i], buffer[j] = buffer[j], buffer[i] })
+	for _, sample := range buffer {
+		if !send(sample) {
+			return
+		}
+	}
+	if len(chunk) > 0 {
+		select {
+		case it.chunks <- chunk:
+		case <-it.done:
+		}
+	}
+}
+
+func (it *streamIterator) Next(batch []Data) int {
+	n := 0
+	for n < len(batch) {
+		if len(it.chunk) == 0 {
+			chunk, ok := <-it.chunks
+			if !ok {
+				break
+			}
+			it.chunk = chunk
+		}
+		copied := copy(batch[n:], it.chunk)
+		it.chunk = it.chunk[copied:]
+		n += copied
+	}
+	return n
+}
+
+// Close stops the background reader, when the pass is not over, and waits
+// until it has closed its files
+func (it *streamIterator) Close() {
+	select {
+	case <-it.done:
+	default:
+		close(it.done)
+	}
+	<-it.finished
+}
+
+// ReadSamples reads the first count samples of the files, or all of them
+// when the files have fewer samples
+func ReadSamples(paths []string, count int) []Data {
+	reader := openSamples(paths)
+	defer reader.Close()
+	data := make([]Data, 0, count)
+	for len(data) < count {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		weighSample(&sample, reader.Position())
+		data = append(data, sample)
+	}
+	printSkipped(reader.Skipped())
+	return data
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func writeDataset(t *testing.T, samples int) string {
+	path := filepath.Join(t.TempDir(), "dataset.epd")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < samples; i++ {
+		fmt.Fprintf(f, "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:%d;eval:0;qs:0;outcome:0.5\n", i)
+	}
+	return path
+}
+
+func readScores(it Iterator, batchSize int) []int {
+	defer it.Close()
+	scores := make([]int, 0)
+	batch := make([]Data, batchSize)
+	for {
+		n := it.Next(batch)
+		for _, sample := range batch[:n] {
+			scores = append(scores, int(sample.Score))
+		}
+		if n < batchSize {
+			return scores
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	path := writeDataset(t, 5000)
+	binpack := filepath.Join(t.TempDir(), "dataset.bin")
+	SaveDataset(path, binpack)
+
+	for _, stream := range []*Stream{
+		{Paths: []string{path}, Skip: 100, ShuffleBuffer: 300},
+		{Paths: []string{binpack}, Skip: 100, ShuffleBuffer: 300},
+		{Paths: []string{path}, Skip: 100},
+	} {
+		scores := readScores(stream.Iterate(), 64)
+		expected := 4900
+		if len(scores) != expected {
+			t.Fatalf("Expected %d samples, got %d", expected, len(scores))
+		}
+
+		shuffled := !sort.IntsAreSorted(scores)
+		if shuffled != (stream.ShuffleBuffer > 0) {
+			t.Errorf("Samples should be shuffled only with a shuffle buffer")
+		}
+		sort.Ints(scores)
+		for i := 0; i < 4900; i++ {
+			if scores[i] != 100+i {
+				t.Fatalf("Sample %d is missing, or read more than once", 100+i)
+			}
+		}
+	}
+
+	// Files are read one after the other
+	if scores := readScores((&Stream{Paths: []string{path, path}}).Iterate(), 64); len(scores) != 10000 {
+		t.Errorf("Expected 10000 samples, got %d", len(scores))
+	}
+
+	// Closing the iterator early stops the reader
+	it := (&Stream{Paths: []string{path}, ShuffleBuffer: 10}).Iterate()
+	if n := it.Next(make([]Data, 10)); n != 10 {
+		t.Errorf("Expected 10 samples, got %d", n)
+	}
+	it.Close()
+}
+
+func TestInMemory(t *testing.T) {
+	data := make([]Data, 10)
+	for i := range data {
+		data[i].Score = int16(i)
+	}
+	scores := readScores(InMemory(data).Iterate(), 4)
+	if len(scores) != 10 || !sort.IntsAreSorted(scores) {
+		t.Errorf("Got %v, Expected all the samples in order", scores)
+	}
+
+	validation := ReadSamples([]string{writeDataset(t, 20)}, 5)
+	if len(validation) != 5 || validation[4].Score != 4 {
+		t.Errorf("Expected the first 5 samples, got %v", validation)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	// Closing a pass early stops the reader before Close returns
+	stream := &Stream{Paths: []string{writeDataset(t, 50000)}, ShuffleBuffer: 100000}
+	it := stream.Iterate().(*streamIterator)
+	it.Close()
+	select {
+	case <-it.finished:
+	default:
+		t.Errorf("Expected the reader to be stopped")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+// The binpack tools work on binpacks of any version, and write binpacks of
+// positions unless some of the inputs are binpacks of features. The filters
+// apply to the samples that are read as usual
+
+// copySamples writes every sample of the reader with the writer that is
+// selected for it, samples without a writer are dropped
+func copySamples(reader *binpackReader, selected func() *BinpackWriter) {
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			return
+		}
+		if writer := selected(); writer != nil {
+			writer.Write(sample, reader.Position())
+		}
+	}
+}
+
+// checkBinpacks panics when some of the inputs are not binpacks, text inputs
+// have to be stored as binpacks first
+func checkBinpacks(paths []string) {
+	for _, path := range paths {
+		if !isBinpack(path) {
+			panic(fmt.Sprintf("%s is not a binpack, the binpack tools only read binpacks", path))
+		}
+	}
+}
+
+// countBinpacks returns the number of samples of the binpacks that are kept
+// by the filters, the binpacks are read to count them when there are filters
+func countBinpacks(paths []string, positionsOnly bool) int64 {
+	total := int64(0)
+	if len(Filters) == 0 {
+		for _, path := range paths {
+			total += int64(binpackSamples(path))
+		}
+		return total
+	}
+	reader := &binpackReader{paths: paths, positionsOnly: positionsOnly}
+	defer reader.Close()
+	for {
+		if _, ok := reader.Read(); !ok {
+			break
+		}
+		total++
+	}
+	resetFiltered()
+	return total
+}
+
+// readBinpack reads all the samples of the binpack with their positions, that
+// are nil for binpacks of features
+func readBinpack(path string, positionsOnly bool) ([]Data, []*Position) {
+	reader := &binpackReader{paths: []string{path}, positionsOnly: positionsOnly}
+	defer reader.Close()
+	data := make([]Data, 0, binpackSamples(path))
+	positions := make([]*Position, 0, cap(data))
+	for {
+		sample, ok := reader.Read()
+		if !ok {
+			break
+		}
+		data = append(data, sample)
+		positions = append(positions, reader.Position())
+	}
+	return data, positions
+}
+
+// MergeBinpacks concatenates the binpacks in order
+func MergeBinpacks(paths []string, output string) {
+	checkBinpacks(paths)
+	create, positions := outputBinpacks(paths)
+	reader := &binpackReader{paths: paths, positionsOnly: positions}
+	defer reader.Close()
+	writer := create(output)
+	copySamples(reader, func() *BinpackWriter { return writer })
+	writer.Close()
+	fmt.Printf("Merged %d samples into %s\n", writer.samples, output)
+	printFiltered()
+}
+
+// DeduplicateBinpacks removes the repeated positions of the binpacks with the
+// Deduplication policy
+func DeduplicateBinpacks(paths []string, output string) {
+	checkBinpacks(paths)
+	create, positions := outputBinpacks(paths)
+	reader := &binpackReader{paths: paths, positionsOnly: positions}
+	defer reader.Close()
+	storeSamples(reader, create(output))
+}
+
+// MaxOpenBuckets is the number of temporary binpacks that are written at the
+// same time while shuffling, the inputs are read once for every group of
+// buckets
+var MaxOpenBuckets = 64
+
+// ShuffleBinpacks shuffles all the samples of the binpacks, out of core. The
+// samples are first scattered randomly into temporary binpacks of about
+// bucketSize samples each, which are then shuffled in memory one at a time
+// and appended to the output. The buckets are written in passes of at most
+// MaxOpenBuckets, every pass draws the same buckets for the samples
+func ShuffleBinpacks(paths []string, output string, bucketSize int) {
+	checkBinpacks(paths)
+	create, positions := outputBinpacks(paths)
+	total := countBinpacks(paths, positions)
+	buckets := int((total + int64(bucketSize) - 1) / int64(bucketSize))
+	if buckets < 1 {
+		buckets = 1
+	}
+
+	temporary := make([]string, buckets)
+	for i := range temporary {
+		temporary[i] = fmt.Sprintf("%s.shuffle-%d", output, i)
+	}
+	defer func() {
+		for _, path := range temporary {
+			os.Remove(path)
+		}
+	}()
+
+	seed := rand.Int63()
+	for first := 0; first < buckets; first += MaxOpenBuckets {
+		writers := make([]*BinpackWriter, min(MaxOpenBuckets, buckets-first))
+		for i := range writers {
+			writers[i] = create(temporary[first+i])
+		}
+		random := rand.New(rand.NewSource(seed))
+		reader := &binpackReader{paths: paths, positionsOnly: positions}
+		copySamples(reader, func() *BinpackWriter {
+			if bucket := random.Intn(buckets) - first; bucket >= 0 && bucket < len(writers) {
+				return writers[bucket]
+			}
+			return nil
+		})
+		reader.Close()
+		for _, writer := range writers {
+			writer.Close()
+		}
+		if first == 0 {
+			printFiltered()
+		} else {
+			resetFiltered()
+		}
+	}
+
+	writer := create(output)
+	for i, path := range temporary {
+		data, positions := readBinpack(path, positions)
+		rand.Shuffle(len(data), func(i, j int) {
+			data[i], data[j] = data[j], data[i]
+			positions[i], positions[j] = positions[j], positions[i]
+		})
+		for j, sample := range data {
+			writer.Write(sample, positions[j])
+		}
+		os.Remove(path)
+		fmt.Printf("Shuffled %d of %d buckets\r", i+1, buckets)
+	}
+	writer.Close()
+	fmt.Printf("\nShuffled %d samples into %s\n", writer.samples, output)
+}
+
+// SplitBinpacks randomly splits the samples of the binpacks into a training
+// and a validation binpack, where ratio of the samples are kept for
+// validation. The samples keep their order
+func SplitBinpacks(paths []string, training, validation string, ratio float64) {
+	checkBinpacks(paths)
+	create, positions := outputBinpacks(paths)
+	total := countBinpacks(paths, positions)
+	validationSize := int64(ratio*float64(total) + 0.5)
+
+	reader := &binpackReader{paths: paths, positionsOnly: positions}
+	defer reader.Close()
+	trainingWriter := create(training)
+	validationWriter := create(validation)
+	selection := newSelection(validationSize, total)
+	copySamples(reader, func() *BinpackWriter {
+		if selection.next() {
+			return validationWriter
+		}
+		return trainingWriter
+	})
+	trainingWriter.Close()
+	validationWriter.Close()
+	fmt.Printf("Split %d training samples into %s and %d validation samples into %s\n",
+		trainingWriter.samples, training, validationWriter.samples, validation)
+	printFiltered()
+}
+
+// SampleBinpacks writes a random sample of count samples of the binpacks,
+// the samples keep their order
+func SampleBinpacks(paths []string, output string, count int64) {
+	checkBinpacks(paths)
+	create, positions := outputBinpacks(paths)
+	total := countBinpacks(paths, positions)
+
+	reader := &binpackReader{paths: paths, positionsOnly: positions}
+	defer reader.Close()
+	writer := create(output)
+	selection := newSelection(count, total)
+	copySamples(reader, func() *BinpackWriter {
+		if selection.next() {
+			return writer
+		}
+		return nil
+	})
+	writer.Close()
+	fmt.Printf("Sampled %d of %d samples into %s\n", writer.samples, total, output)
+	printFiltered()
+}
+
+// selection picks exactly wanted of total items in a single pass, each subset
+// being equally likely (Knuth's algorithm S)
+type selection struct {
+	wanted, total int64
+}
+
+func newSelection(wanted, total int64) *selection {
+	return &selection{wanted: wanted, total: total}
+}
+
+// next returns whether the next item is picked
+func (s *selection) next() bool {
+	if s.total <= 0 {
+		return false
+	}
+	picked := rand.Int63n(s.total) < s.wanted
+	s.total--
+	if picked {
+		s.wanted--
+	}
+	return picked
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeBinpack(t *testing.T, path string, from, to int) {
+	writer := CreateFeatureBinpack(path)
+	for i := from; i < to; i++ {
+		writer.Write(Data{Input: []int16{int16(i % 768)}, Score: int16(i), Outcome: int8(i % 3)}, nil)
+	}
+	writer.Close()
+}
+
+func scoresOf(data []Data) []int {
+	scores := make([]int, len(data))
+	for i, sample := range data {
+		scores[i] = int(sample.Score)
+	}
+	return scores
+}
+
+func TestBinpackTools(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.bin")
+	second := filepath.Join(dir, "second.bin")
+	writeBinpack(t, first, 0, 60)
+	writeBinpack(t, second, 60, 100)
+	inputs := []string{first, second}
+
+	merged := filepath.Join(dir, "merged.bin")
+	MergeBinpacks(inputs, merged)
+	for i, score := range scoresOf(loadBinpack(merged)) {
+		if score != i {
+			t.Fatalf("Expected the merged samples in order, got %d at %d", score, i)
+		}
+	}
+
+	defer func(policy DuplicatePolicy) { Deduplication = policy }(Deduplication)
+	Deduplication = KeepFirst
+	unique := filepath.Join(dir, "unique.bin")
+	DeduplicateBinpacks([]string{first, first}, unique)
+	if scores := scoresOf(loadBinpack(unique)); len(scores) != 60 || !sort.IntsAreSorted(scores) {
+		t.Errorf("Expected the 60 samples of the first binpack once, got %v", scores)
+	}
+
+	// The 15 buckets are written in 4 passes
+	defer func(buckets int) { MaxOpenBuckets = buckets }(MaxOpenBuckets)
+	MaxOpenBuckets = 4
+	shuffled := filepath.Join(dir, "shuffled.bin")
+	ShuffleBinpacks(inputs, shuffled, 7)
+	scores := scoresOf(loadBinpack(shuffled))
+	if sort.IntsAreSorted(scores) {
+		t.Errorf("Expected the samples to be shuffled")
+	}
+	sort.Ints(scores)
+	for i, score := range scores {
+		if score != i {
+			t.Fatalf("Expected the shuffled samples to be a permutation, got %d at %d", score, i)
+		}
+	}
+	if matches, _ := filepath.Glob(shuffled + ".shuffle-*"); len(matches) != 0 {
+		t.Errorf("Expected the temporary binpacks to be removed, got %v", matches)
+	}
+
+	training := filepath.Join(dir, "training.bin")
+	validation := filepath.Join(dir, "validation.bin")
+	SplitBinpacks(inputs, training, validation, 0.25)
+	trainingScores := scoresOf(loadBinpack(training))
+	validationScores := scoresOf(loadBinpack(validation))
+	if len(trainingScores) != 75 || len(validationScores) != 25 {
+		t.Errorf("Expected 75 training and 25 validation samples, got %d and %d", len(trainingScores), len(validationScores))
+	}
+	all := append(trainingScores, validationScores...)
+	sort.Ints(all)
+	for i, score := range all {
+		if score != i {
+			t.Fatalf("Expected the split samples to cover all samples, got %d at %d", score, i)
+		}
+	}
+
+	sampled := filepath.Join(dir, "sampled.bin")
+	SampleBinpacks(inputs, sampled, 10)
+	scores = scoresOf(loadBinpack(sampled))
+	if len(scores) != 10 || !sort.IntsAreSorted(scores) {
+		t.Errorf("Expected 10 samples in order, got %v", scores)
+	}
+
+	// The samples are selected among the samples that the filters keep
+	defer func(filters []*Filter) { Filters = filters }(Filters)
+	Filters = []*Filter{ScoreFilter(0, 49)}
+	SampleBinpacks(inputs, sampled, 50)
+	scores = scoresOf(loadBinpack(sampled))
+	if len(scores) != 50 || scores[0] != 0 || scores[49] != 49 {
+		t.Errorf("Expected all 50 filtered samples, got %v", scores)
+	}
+	SplitBinpacks(inputs, training, validation, 0.2)
+	if n := len(loadBinpack(validation)); n != 10 {
+		t.Errorf("Expected 10 validation samples, got %d", n)
+	}
+
+	// Text inputs are rejected
+	text := filepath.Join(dir, "dataset.epd")
+	if err := os.WriteFile(text, []byte("4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "is not a binpack") {
+			t.Errorf("Expected the text input to be rejected, got %v", r)
+		}
+	}()
+	MergeBinpacks([]string{first, text}, merged)
+}
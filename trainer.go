@@ -14,7 +14,7 @@ type (
 
 	Trainer struct {
 		Nets            []*Network
-		Training        []Data
+		Training        Source
 		Validation      []Data
 		Epochs          int
 		ValidationCosts []float32
@@ -29,10 +29,14 @@ var (
 	BatchSize               = 16384
 )
 
-func NewTrainer(net Network, dataset []Data, epochs int) *Trainer {
+// SplitDataset keeps the first 20% of the dataset, and at most 5M samples,
+// for validation and trains on the rest
+func SplitDataset(dataset []Data) (Source, []Data) {
 	validationSize := min(20*len(dataset)/100, 5_000_000)
-	validation := (dataset)[:validationSize]
-	training := (dataset)[validationSize:]
+	return InMemory(dataset[validationSize:]), dataset[:validationSize]
+}
+
+func NewTrainer(net Network, training Source, validation []Data, epochs int) *Trainer {
 	networks := make([]*Network, NumberOfThreads)
 	for i := 0; i < len(networks); i++ {
 		networks[i] = net.Copy()
@@ -52,6 +56,7 @@ func (t *Trainer) CopyNets() {
 	for i := 1; i < len(t.Nets); i++ {
 		t.Nets[i].Weights = t.Nets[0].Weights
 		t.Nets[i].Biases = t.Nets[0].Biases
+		t.Nets[i].PSQT = t.Nets[0].PSQT
 	}
 }
 
@@ -72,6 +77,15 @@ func (t *Trainer) SyncGradients() {
 				t.Nets[i].BGradients[j].Data[k].Reset()
 			}
 		}
+
+		if t.Nets[i].Topology.PSQT {
+			pgrad := t.Nets[i].PSQTGradients
+			size := pgrad.Size()
+			for k := uint32(0); k < size; k++ {
+				t.Nets[0].PSQTGradients.Data[k].Update(pgrad.Data[k].Value)
+				t.Nets[i].PSQTGradients.Data[k].Reset()
+			}
+		}
 	}
 }
 
@@ -85,16 +99,7 @@ func (t *Trainer) PrintCost() float32 {
 	for i := 0; i < NumberOfThreads; i++ {
 		batch := (t.Validation)[i*batchSize : (i+1)*batchSize]
 		go func(n *Network, batch []Data, answer chan float32) {
-			localCost := float32(0)
-			for d := 0; d < len(batch); d++ {
-				data := batch[d]
-
-				predicted := n.Predict(data.Input)
-				cost := ValidationCost(predicted, Sigmoid(float32(data.Score)), float32(data.Outcome)/2)
-
-				localCost += cost
-			}
-			answer <- localCost
+			answer <- n.CostBatch(batch)
 		}(t.Nets[i], batch, answer)
 	}
 	for i := 0; i < NumberOfThreads; i++ {
@@ -105,23 +110,31 @@ func (t *Trainer) PrintCost() float32 {
 	return averageCost
 }
 
-func (t *Trainer) StartEpoch(startTime time.Time) float32 {
-	batchEnd := BatchSize
+// StartEpoch trains on all the full batches of the training samples, and
+// returns the total cost and the number of samples
+func (t *Trainer) StartEpoch(startTime time.Time) (float32, int) {
 	samples := 0
 	totalCost := float32(0)
-	for batchEnd < len(t.Training) {
-		newBatch := (t.Training)[batchEnd-BatchSize : batchEnd]
+	iterator := t.Training.Iterate()
+	defer iterator.Close()
+	newBatch := make([]Data, BatchSize)
+	for iterator.Next(newBatch) == BatchSize {
 		miniBatchSize := len(newBatch) / NumberOfThreads
 		answers := make(chan float32)
 		for i := 0; i < NumberOfThreads; i++ {
 			smallBatch := newBatch[i*miniBatchSize : (i+1)*miniBatchSize]
 			go func(main bool, n *Network, batch []Data, answer chan float32) {
-				localCost := float32(0)
-				for d := 0; d < len(batch); d++ {
-					data := batch[d]
-					localCost += n.Train(data.Input, Sigmoid(float32(data.Score)), float32(data.Outcome)/2)
+				if Augmenting() {
+					augmented := make([]Data, 0, 4*len(batch))
+					for _, sample := range batch {
+						augmented = Augment(augmented, sample, n.FeatureSet())
+					}
+					// The cost is scaled back to the number of samples, so
+					// that it is comparable with the validation cost
+					answer <- n.TrainBatch(augmented) * float32(len(batch)) / float32(len(augmented))
+					return
 				}
-				answer <- localCost
+				answer <- n.TrainBatch(batch)
 			}(i == 0, t.Nets[i], smallBatch, answers)
 		}
 		for i := 0; i < NumberOfThreads; i++ {
@@ -133,23 +146,22 @@ func (t *Trainer) StartEpoch(startTime time.Time) float32 {
 		t.SyncGradients()
 		t.Nets[0].ApplyGradients()
 		t.CopyNets()
-		batchEnd += BatchSize
 	}
 
-	return totalCost
+	return totalCost, samples
 }
 
 func (t *Trainer) Train(path string) {
 	for epoch := 0; epoch < t.Epochs; epoch++ {
 		startTime := time.Now()
 		fmt.Printf("Started Epoch %d at %s\n", epoch+1, startTime.String())
-		fmt.Printf("Number of samples: %d\n", len(t.Training))
-		totalCost := t.StartEpoch(startTime)
+		totalCost, samples := t.StartEpoch(startTime)
 		fmt.Printf("\nFinished Epoch %d at %s, elapsed time %s\n", epoch+1, time.Now().String(), time.Since(startTime).String())
 		fmt.Printf("Storing This Epoch %d network\n", epoch+1)
 		t.Nets[0].Save(fmt.Sprintf("%s%cepoch-%d.nnue", path, os.PathSeparator, epoch+1))
 		fmt.Printf("Stored This Epoch %d's network\n", epoch+1)
-		averageCost := totalCost / float32(len(t.Training))
+		fmt.Printf("Number of samples: %d\n", samples)
+		averageCost := totalCost / float32(samples)
 		t.ValidationCosts[epoch] = t.PrintCost()
 		t.TrainingCosts[epoch] = averageCost
 		fmt.Printf("Current training cost is: %f\n", averageCost)
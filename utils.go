@@ -37,3 +37,43 @@ func ValidationCost(output, evalTarget, wdlTarget float32) float32 {
 	return CostEvalWeight*float32(math.Pow(float64(output-evalTarget), 2.0)) +
 		CostWDLWeight*float32(math.Pow(float64(output-wdlTarget), 2.0))
 }
+
+// ClippedReLu clamps x to [0, 1]
+func ClippedReLu(x float32) float32 {
+	if x < 0 {
+		return 0
+	} else if x > 1 {
+		return 1
+	}
+	return x
+}
+
+// ClippedReLuPrime takes the output of ClippedReLu
+func ClippedReLuPrime(x float32) float32 {
+	if x > 0.0 && x < 1.0 {
+		return 1.0
+	}
+	return 0.0
+}
+
+// SquaredClippedReLu is the square of ClippedReLu
+func SquaredClippedReLu(x float32) float32 {
+	x = ClippedReLu(x)
+	return x * x
+}
+
+// SquaredClippedReLuPrime takes the output of SquaredClippedReLu
+func SquaredClippedReLuPrime(x float32) float32 {
+	if x > 0.0 && x < 1.0 {
+		return 2.0 * float32(math.Sqrt(float64(x)))
+	}
+	return 0.0
+}
+
+func Linear(x float32) float32 {
+	return x
+}
+
+func LinearPrime(x float32) float32 {
+	return 1.0
+}
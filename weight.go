@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+type (
+	// WeightRule scales the weight of the samples, pos is nil for samples whose
+	// position is not known, i.e. samples of binpacks of features. Rules that
+	// need the position leave such samples alone
+	WeightRule struct {
+		Name   string
+		Weight func(sample *Data, pos *Position) float32
+	}
+)
+
+// WeightRules scale the weight of the samples that are trained on, on top of
+// the weights of the samples themselves. They are not applied when datasets
+// are stored, so stored binpacks keep the weights of their inputs
+var WeightRules []*WeightRule
+
+// weighSample applies the weight rules to the sample, pos can be nil
+func weighSample(sample *Data, pos *Position) {
+	if len(WeightRules) == 0 {
+		return
+	}
+	weight := sample.lossWeight()
+	for _, rule := range WeightRules {
+		weight *= rule.Weight(sample, pos)
+	}
+	sample.setWeight(weight)
+}
+
+// DrawWeight scales the weight of the drawn samples, a scale of 0 leaves
+// them out of the loss
+func DrawWeight(scale float32) *WeightRule {
+	if scale < 0 {
+		panic(fmt.Sprintf("The weight of the draws can not be negative, got %g", scale))
+	}
+	return &WeightRule{
+		Name: fmt.Sprintf("draws weigh %g", scale),
+		Weight: func(sample *Data, _ *Position) float32 {
+			if sample.Outcome == 1 {
+				return scale
+			}
+			return 1
+		},
+	}
+}
+
+// PlyWeight ramps the weight of the positions up linearly over the first
+// plies of the game, the positions after them and the positions without
+// clocks keep their weight
+func PlyWeight(plies int) *WeightRule {
+	return &WeightRule{
+		Name: fmt.Sprintf("the first %d plies weigh less", plies),
+		Weight: func(_ *Data, pos *Position) float32 {
+			if pos == nil || !pos.HasClocks {
+				return 1
+			}
+			ply := 2 * (int(pos.FullMoveNumber) - 1)
+			if pos.SideToMove == Black {
+				ply++
+			}
+			if ply >= plies {
+				return 1
+			}
+			return float32(ply+1) / float32(plies+1)
+		},
+	}
+}
+
+// ScoreWeight scales the weight of the samples down by their absolute score,
+// a sample with a score of scale weighs half as much as a sample with a score
+// of zero
+func ScoreWeight(scale float64) *WeightRule {
+	return &WeightRule{
+		Name: fmt.Sprintf("scores weigh less by %g", scale),
+		Weight: func(sample *Data, _ *Position) float32 {
+			return float32(1 / (1 + math.Abs(float64(sample.Score))/scale))
+		},
+	}
+}
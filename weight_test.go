@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWeightField(t *testing.T) {
+	line := "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1;score:10;eval:0;qs:0;outcome:0.5"
+	if data := ParseLine(line); data.Weight != 0 || data.lossWeight() != 1 {
+		t.Errorf("Expected the default weight, got %f", data.Weight)
+	}
+	if data := ParseLine(line + ";weight:2.5"); data.lossWeight() != 2.5 {
+		t.Errorf("Expected a weight of 2.5, got %f", data.Weight)
+	}
+	for _, weight := range []string{"0", "-1", "abc", "NaN", "Inf"} {
+		if _, err := TryParseLine(line + ";weight:" + weight); err == nil || err.(*ParseError).Category != BadWeight {
+			t.Errorf("Expected weight %s to be rejected, got %v", weight, err)
+		}
+	}
+}
+
+func TestWeightRules(t *testing.T) {
+	defer func(rules []*WeightRule) { WeightRules = rules }(WeightRules)
+	WeightRules = []*WeightRule{DrawWeight(0.5), PlyWeight(9), ScoreWeight(100)}
+
+	weigh := func(line string) float32 {
+		sample, pos, err := parseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		weighSample(&sample, &pos)
+		return sample.lossWeight()
+	}
+
+	tests := map[string]float32{
+		// Ply 20, no draw and no score
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 11;score:0;eval:0;qs:0;outcome:1.0": 1,
+		// A draw at ply 20
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 11;score:0;eval:0;qs:0;outcome:0.5": 0.5,
+		// Ply 3
+		"4k3/8/8/8/8/8/4P3/4K3 b - - 0 2;score:0;eval:0;qs:0;outcome:1.0": 0.4,
+		// A score of 300 with a weight of 2
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 11;score:-300;eval:0;qs:0;outcome:0.0;weight:2": 0.5,
+	}
+	for line, expected := range tests {
+		if weight := weigh(line); math.Abs(float64(weight-expected)) > 1e-6 {
+			t.Errorf("%s: expected a weight of %f, got %f", line, expected, weight)
+		}
+	}
+
+	// Positions without clocks keep their weight
+	defer func(format Format) { TextFormat = format }(TextFormat)
+	TextFormat = EPDFormat
+	if weight := weigh("4k3/8/8/8/8/8/4P3/4K3 w - - [1.0] 0"); weight != 1 {
+		t.Errorf("Expected a weight of 1 without clocks, got %f", weight)
+	}
+
+	// Binpack samples have no position
+	sample := Data{Score: 100, Outcome: 1}
+	weighSample(&sample, nil)
+	if sample.lossWeight() != 0.25 {
+		t.Errorf("Expected a binpack sample weight of 0.25, got %f", sample.Weight)
+	}
+
+	// Draws that weigh 0 are left out of the loss
+	WeightRules = []*WeightRule{DrawWeight(0)}
+	sample = Data{Score: 100, Outcome: 1}
+	weighSample(&sample, nil)
+	if sample.lossWeight() != 0 {
+		t.Errorf("Expected a draw weight of 0, got %f", sample.lossWeight())
+	}
+}
+
+func TestStoredWeights(t *testing.T) {
+	defer func(rules []*WeightRule) { WeightRules = rules }(WeightRules)
+	WeightRules = []*WeightRule{DrawWeight(0.5)}
+
+	// The weight rules apply to the samples that are trained on, not to the
+	// stored ones
+	dir := t.TempDir()
+	text := filepath.Join(dir, "dataset.epd")
+	lines := "4k3/8/8/8/8/8/4P3/4K3 w - - 0 11;score:0;eval:0;qs:0;outcome:0.5\n" +
+		"4k3/8/8/8/8/8/4P3/4K3 w - - 0 11;score:0;eval:0;qs:0;outcome:0.5;weight:2\n"
+	if err := os.WriteFile(text, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	binpack := filepath.Join(dir, "dataset.bin")
+	SaveDataset(text, binpack)
+	stored := loadBinpack(binpack)
+	if len(stored) != 2 || stored[0].lossWeight() != 1 || stored[1].lossWeight() != 2 {
+		t.Errorf("Expected the stored weights 1 and 2, got %v", stored)
+	}
+	loaded := LoadDataset(binpack)
+	if len(loaded) != 2 || loaded[0].lossWeight() != 0.5 || loaded[1].lossWeight() != 1 {
+		t.Errorf("Expected the trained weights 0.5 and 1, got %v", loaded)
+	}
+}
+
+func TestBinpackWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weights.bin")
+	writer := CreateFeatureBinpack(path)
+	samples := []Data{
+		{Input: []int16{1, 2, 3}, Score: -5, Outcome: 0},
+		{Input: []int16{4, 5}, Score: 7, Outcome: 2, Weight: 0.75, Weighted: true},
+		{Input: []int16{6}, Score: 9, Outcome: 1, Weight: 0, Weighted: true},
+	}
+	for _, sample := range samples {
+		writer.Write(sample, nil)
+	}
+	writer.Close()
+
+	data := loadBinpack(path)
+	for i, sample := range data {
+		if sample.Score != samples[i].Score || sample.Outcome != samples[i].Outcome || sample.lossWeight() != samples[i].lossWeight() || !sameFeatures(sample.Input, samples[i].Input) {
+			t.Errorf("Expected %v, got %v", samples[i], sample)
+		}
+	}
+}